@@ -6,15 +6,28 @@ package main
 import (
     "bufio"
     "bytes"
+    "crypto/hmac"
+    cryptorand "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "errors"
     "fmt"
     "io"
+    "io/ioutil"
     "log"
+    "math"
+    "math/rand"
     "net"
+    "net/http"
     "os"
     "os/signal"
     "regexp"
+    "sort"
     "strconv"
     "strings"
+    "sync"
     "sync/atomic"
     "syscall"
     "time"
@@ -28,6 +41,39 @@ type PortsConfigurationData struct {
     hostPort int;
     maxConnections int;
     sendProxyFlag bool;
+    strategy string;
+    weight int;
+    proxyVersion int;
+    connectTimeout time.Duration;
+    backup bool;
+    podId string;
+    mirror bool;
+    check string;
+    checkPath string;
+    checkInterval time.Duration;
+    checkTimeout time.Duration;
+    slowStart time.Duration;
+    rateIn int64;
+    rateOut int64;
+}
+
+type ClusterPortOptions struct {
+    rateIn int64;
+    rateOut int64;
+}
+
+type TimeoutSettings struct {
+    dialTimeout time.Duration;
+    handshakeTimeout time.Duration;
+    proxyHeaderTimeout time.Duration;
+    idleTimeout time.Duration;
+    maxConnectionLifetime time.Duration;
+}
+
+type ClientLimitSettings struct {
+    rate float64;
+    burst int;
+    maxConnections int;
 }
 
 type ProgramSettings struct {
@@ -38,63 +84,229 @@ type ProgramSettings struct {
     listenerPort int;
     clusterPortsRangeMin int;
     clusterPortsRangeMax int;
+    zone string;
+    hostsResolveInterval time.Duration;
+    hostsSelection string;
+    timeouts TimeoutSettings;
+    clusterPortTimeouts map[int]TimeoutSettings;
+    clientLimits ClientLimitSettings;
+    clusterPortClientLimits map[int]ClientLimitSettings;
+    adminListenerHost string;
+    adminListenerPort int;
+    adminTokenFile string;
+    mirrorBufferSize int;
+    outlierConsecutiveFailures int;
+    outlierBaseEjectionTime time.Duration;
+    outlierMaxEjectionTime time.Duration;
+    slowStartWindow time.Duration;
+    retryOnEarlyClose bool;
+    replayBufferSize int;
+    tlsCertificateFile string;
+    tlsKeyFile string;
+    tlsCaFile string;
+    listenerRestrictSources bool;
+    listenerAllowedCidrs []*net.IPNet;
+    authSecretFile string;
+    authMaxClockSkew time.Duration;
+    trustedProxyCidrs []*net.IPNet;
+    untrustedProxyHeaders string;
+    internalHeader string;
+    accessControlFile string;
+}
+
+type HostsConfigurationData struct {
+    index int;
+    host string;
+    address string;
+    port int;
+    zone string;
+    weight int;
+    name string;
+}
+
+type AccessControlData struct {
+    allow []*net.IPNet;
+    deny []*net.IPNet;
 }
 
 type PortsConfigurationMap map[int][]PortsConfigurationData;
-type HostsConfigurationMap map[string]int;
+type ClusterPortOptionsMap map[int]ClusterPortOptions;
+type HostsConfigurationMap map[string]HostsConfigurationData;
+type AccessControlMap map[int]*AccessControlData;
+
+type ClientBucket struct {
+    tokens float64;
+    updated time.Time;
+    activeConnections int;
+}
+
+type ClientLimiter struct {
+    lock sync.Mutex;
+    clients map[string]*ClientBucket;
+    lastSweep time.Time;
+}
+
+type HostsResolver struct {
+    lock sync.RWMutex;
+    addresses map[string][]string;
+}
+
+type HostPortsBalancer struct {
+    lock sync.Mutex;
+    activeConnectionsCount map[int]int;
+    roundRobinIndex map[int]int;
+    routedConnections map[int]map[int]int64;
+    firstSeen map[int]time.Time;
+    slowStartWindow time.Duration;
+}
+
+type Metrics struct {
+    lock sync.Mutex;
+    values map[string]int64;
+    ratios map[string]float64;
+}
+
+type ConnectionInfo struct {
+    clusterPort int;
+    hostPort int;
+    podId string;
+    client string;
+    startTime time.Time;
+    clientConnection net.Conn;
+    hostConnection net.Conn;
+}
+
+type ConnectionRegistry struct {
+    lock sync.Mutex;
+    nextId int64;
+    connections map[int64]*ConnectionInfo;
+    drainedPods map[string]bool;
+}
+
+type HealthChecker struct {
+    lock sync.Mutex;
+    unhealthy map[int]bool;
+    lastCheck map[int]time.Time;
+    checking map[int]bool;
+}
+
+type OutlierDetector struct {
+    lock sync.Mutex;
+    consecutiveFailures int;
+    baseEjectionTime time.Duration;
+    maxEjectionTime time.Duration;
+    failures map[string]int;
+    ejections map[string]int;
+    ejectedUntil map[string]time.Time;
+}
+
+type CertificateStore struct {
+    lock sync.RWMutex;
+    certificateFile string;
+    keyFile string;
+    caFile string;
+    certificate *tls.Certificate;
+    caPool *x509.CertPool;
+    modTimes map[string]time.Time;
+}
+
+type InternalHeader struct {
+    clusterPort int;
+    clientIp string;
+    clientPort int;
+    proxyIp string;
+    proxyPort int;
+    proxyHeader string;
+}
+
+type HandshakeAuthenticator struct {
+    lock sync.Mutex;
+    secret []byte;
+    maxClockSkew time.Duration;
+    nonces map[string]time.Time;
+    lastSweep time.Time;
+}
 
-type ClientWriter struct {
-    io.Writer
+type MirrorWriter struct {
+    chunks chan []byte;
+    bufferedBytes int64;
+    maxBufferedBytes int64;
+    dropped int32;
+    onDrop func();
+    lock sync.Mutex;
+    connection net.Conn;
+    closed bool;
 }
 
-type SignalReader struct {
+type ActivityReader struct {
     io.Reader
+    lastActivity *int64;
+    bytesRead *int64;
 }
 
-func (writer ClientWriter) Write(data []byte) (int, error) {
-    fmt.Printf("Yet to write: %s\n", string(data));
-    if(strings.Contains(string(data), "go away") || strings.Contains(string(data), "go ahead")) {
-        if(len(data) > 9 && (strings.HasPrefix(string(data), "go away\n") || strings.HasPrefix(string(data), "go ahead\n"))) {
-            fmt.Printf("Got go ahead/away prefix\n");
-            buf := make([]byte, len(data));
-            buf = data[9:];
-            fmt.Printf("Buffer: %s\n", string(buf));
-            n, err := writer.Writer.Write(buf);
-            fmt.Printf("wrote %d bytes\n", n);
-            return n, err;
-        } else {
-            fmt.Printf("wrote %d bytes\n", len(string(data)));
-            return len(string(data)), nil;
-        }
-    } else {
-        n, err := writer.Writer.Write(data);
-        fmt.Printf("wrote %d bytes\n", n);
-        return n, err;
-    }
+type ByteRateLimiter struct {
+    lock sync.Mutex;
+    rate int64;
+    tokens float64;
+    updated time.Time;
 }
 
-var foundValidHost int32;
-func (reader SignalReader) Read(dst []byte) (int, error) {
-//    emptySet := make([]byte, 32768)
-    n, err := reader.Reader.Read(dst);
-    if(err == io.EOF) {
-        fmt.Printf("EOF\n");
-    } else {
-        fmt.Printf("read %d bytes: %v\n", n, string(dst));
-//        if(strings.Contains(string(dst), "go away") || bytes.Contains(emptySet, dst)) {
-        if(strings.Contains(string(dst), "go away")) {
-            // TODO: FIXME: consider returning 0 read ?
-            //              ... but then the Read could not roll back...
-            return n, fmt.Errorf("Not a valid host: %v. Skipping...\n", string(dst));
-        } else {
-            fmt.Printf("Making as valid host: %v (%d)\n", string(dst), len(string(dst)));
-            atomic.StoreInt32(&foundValidHost, 1);
-        }
-    }
-    fmt.Printf("done\n");
-    return n, err;
+type BandwidthLimiters struct {
+    lock sync.Mutex;
+    rates map[string]int64;
+    limiters map[string]*ByteRateLimiter;
+}
+
+type ThrottledReader struct {
+    io.Reader
+    limiters []*ByteRateLimiter;
 }
 
+type ProxyHeaderGuard struct {
+    reader *bufio.Reader;
+    checked bool;
+    rejected bool;
+}
+
+type ReplayBuffer struct {
+    reader io.Reader;
+    data []byte;
+    maxSize int;
+    overflowed bool;
+    err error;
+    hostBytesRead *int64;
+}
+
+type ForwardResult struct {
+    bytesToHost int64;
+    bytesToClient int64;
+    hostClosedEarly bool;
+    retry bool;
+}
+
+type closeWriter interface {
+    CloseWrite() (error);
+}
+
+// Mapping status replies
+const responseMappingActive string = "go ahead\n";
+const responseMappingInactive string = "go away\n";
+const responseMappingRejectedPrefix string = "go away ";
+
+// Proxy protocol v1 headers are at most 107 bytes long, "PROXY " and "\r\n" included
+const proxyProtocolMaxHeaderLength int = 107;
+const maxInternalHeaderLength int = 512;
+const maxAuthLineLength int = 128;
+
+// Time given to a mirror host port to take each chunk of mirrored data
+const mirrorWriteTimeout time.Duration = 5 * time.Second;
+
+// Time given to an untrusted source to start with a proxy protocol header, before any host is tried
+const untrustedHeaderPeekTimeout time.Duration = 50 * time.Millisecond;
+
+var errHeaderTooLong error = errors.New("header too long");
+var errUntrustedHeader error = errors.New("untrusted proxy protocol header");
+
 /*============================
  loadConfiguration
 
@@ -219,11 +431,24 @@ func loadConfiguration(cfgFilePath string) (ConfigurationMap) {
  then extracts the file contents and store them into a key-value map.
 
  Base configuration entry format:
-    clusterPort:hostPort:maxConnections:sendProxyFlag
+    clusterPort:hostPort:maxConnections:sendProxyFlag[:strategy][;key=value]...
+
+ Cluster port entry format, see loadClusterPortOptions:
+    clusterPort;key=value[;key=value]...
+
+ A line may start with an "@podId" token, identifying the pod owning all entries of the line.
+
+ The optional strategy selects how host ports of a cluster port share new connections:
+ sequential (default), roundrobin, leastconn, random or weighted. Entries of a cluster
+ port are collected across all lines, in file order.
+ Extended options may follow, each introduced by a semicolon. See loadPortsConfigurationOptions.
 
  Configuration example:
     #clusterPortA:hostPort1:100:true clusterPortA:hostPort2:100:false
     clusterPortB:hostPort10:100:false clusterPortB:hostPort11:100:false
+    clusterPortC:hostPort20:100:true;weight=2;proxy=v2
+    clusterPortC;rateIn=1000000
+    @pod-d clusterPortD:hostPort30:100:false clusterPortD:hostPort31:100:false
     [...]
     ### EOF
 
@@ -231,9 +456,10 @@ func loadConfiguration(cfgFilePath string) (ConfigurationMap) {
     cfgFilePath: local path to configuration file
 
  Returns:
-    Loaded ports configuration map
+    Loaded ports configuration map and cluster port options, both nil when the
+    file cannot be used
 ============================*/
-func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap) {
+func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap, ClusterPortOptionsMap) {
     // Open configuration file
     var cfgFile = func(filePath string) (*os.File) {
         file, err := os.Open(filePath);
@@ -258,7 +484,7 @@ func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap) {
     cfgFileStat, err = cfgFile.Stat();
     if(err != nil) {
         log.Printf("Error stating file %s: %v", cfgFilePath, err);
-        return nil;
+        return nil, nil;
     }
     cfgFileStatSize = cfgFileStat.Size();
     cfgFileLastLine =  make([]byte, eofLineLength)
@@ -266,22 +492,24 @@ func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap) {
     cfgFileLastLineBytesRead, err = cfgFile.ReadAt(cfgFileLastLine, cfgFileLastLineOffset);
     if(cfgFileLastLineBytesRead != eofLineLength) {
         log.Printf("Error reading file %s last line. Expected bytes read (%d) to be the same length as EOF line: %d", cfgFilePath, cfgFileLastLineBytesRead, eofLineLength);
-        return nil;
+        return nil, nil;
     }
     if(err != nil) {
         log.Printf("Error reading file %s last line: %v", cfgFilePath, err);
-        return nil;
+        return nil, nil;
     }
     cfgFileLastLine = cfgFileLastLine[:cfgFileLastLineBytesRead]
     cfgFileLastLineStr = string(cfgFileLastLine);
     if(cfgFileLastLineStr != eofLine) {
         log.Printf("Ports configuration file is still being written to. Skipping ports configuration reload...");
-        return nil;
+        return nil, nil;
     }
 
-    // Extract data from configuration file
-    var portsConfiguration = func(file *os.File) (PortsConfigurationMap) {
+    // Extract data from configuration file. Errors are reported without exiting,
+    // so that a reload keeps the previous configuration
+    var portsConfiguration, clusterPortsOptions = func(file *os.File) (PortsConfigurationMap, ClusterPortOptionsMap) {
         var data = make(PortsConfigurationMap);
+        var clusterPortsData = make(ClusterPortOptionsMap);
         var scanner *bufio.Scanner = bufio.NewScanner(file);
 
         // Try to iterate over all file contents
@@ -293,8 +521,8 @@ func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap) {
             line = scanner.Text();
             log.Printf("Configuration line: %s\n", line);
 
-            // Skip commented out line
-            if(line[0] == '#') {
+            // Skip empty and commented out lines
+            if(len(line) == 0 || line[0] == '#') {
                 continue;
             }
 
@@ -302,48 +530,84 @@ func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap) {
             // then iterate over all entries
             var lineSplitIndex int;
             lineSplit = strings.Split(line, " ");
+
+            // Read optional pod identifier, applying to all entries of the line
+            var linePodId string = "";
+            if(strings.HasPrefix(lineSplit[0], "@")) {
+                linePodId = lineSplit[0][1:];
+                lineSplit = lineSplit[1:];
+            }
             lineSplitLen = len(lineSplit);
-            var portsDataList []PortsConfigurationData;
-            portsDataList = make([]PortsConfigurationData, lineSplitLen);
 
             var clusterPort int;
             for lineSplitIndex=0; lineSplitIndex < lineSplitLen; lineSplitIndex++ {
                 var currentEntry string = lineSplit[lineSplitIndex];
-                var currentEntryValues []string = strings.Split(currentEntry, ":");
+                var currentEntryOptions []string = strings.Split(currentEntry, ";");
+                var currentEntryValues []string = strings.Split(currentEntryOptions[0], ":");
                 var currentEntryValuesLen int = len(currentEntryValues);
-                if(currentEntryValuesLen != 4) {
-                    log.Printf("Error while reading configuration line: %s. Expected format: clusterPort:hostPort:maxConnections:sendProxyFlag. Values: %s. Length: %d", currentEntry, currentEntryValues, currentEntryValuesLen);
-                    os.Exit(1);
+                if(currentEntryValuesLen == 1 && len(currentEntryOptions) > 1) {
+                    // Cluster port entry
+                    log.Printf("Parsing cluster port entry: %s\n", currentEntry);
+                    var err error;
+                    clusterPort, err = strconv.Atoi(currentEntryValues[0]);
+                    if(err != nil) {
+                        log.Printf("Error converting clusterPort: %s. Message: %v", currentEntryValues[0], err);
+                        return nil, nil;
+                    }
+                    var clusterPortOptions ClusterPortOptions = clusterPortsData[clusterPort];
+                    err = loadClusterPortOptions(&clusterPortOptions, currentEntryOptions[1:]);
+                    if(err != nil) {
+                        log.Printf("Error while reading cluster port entry %s: %v", currentEntry, err);
+                        return nil, nil;
+                    }
+                    clusterPortsData[clusterPort] = clusterPortOptions;
+                } else if(currentEntryValuesLen != 4 && currentEntryValuesLen != 5) {
+                    log.Printf("Error while reading configuration line: %s. Expected format: clusterPort:hostPort:maxConnections:sendProxyFlag[:strategy]. Values: %s. Length: %d", currentEntry, currentEntryValues, currentEntryValuesLen);
+                    return nil, nil;
                 } else {
                     log.Printf("Parsing configuration entry: %s\n", currentEntry);
                     var err error;
                     var portsData PortsConfigurationData;
+                    portsData.proxyVersion = 1;
+                    portsData.podId = linePodId;
                     portsData.hostPort, err = strconv.Atoi(currentEntryValues[1]);
                     if(err != nil) {
                         log.Printf("Error converting hostPort: %s. Message: %v", currentEntryValues[1], err);
-                        os.Exit(1);
+                        return nil, nil;
                     }
                     portsData.maxConnections, err = strconv.Atoi(currentEntryValues[2]);
                     if(err != nil) {
                         log.Printf("Error converting maxConnections: %s. Message: %v", currentEntryValues[2], err);
-                        os.Exit(1);
+                        return nil, nil;
                     }
                     portsData.sendProxyFlag, err = strconv.ParseBool(currentEntryValues[3]);
                     if(err != nil) {
                         log.Printf("Error converting sendProxyFlag: %s. Message: %v", currentEntryValues[3], err);
-                        os.Exit(1);
+                        return nil, nil;
+                    }
+
+                    if(currentEntryValuesLen == 5) {
+                        portsData.strategy = currentEntryValues[4];
+                        if(!isHostPortsStrategy(portsData.strategy)) {
+                            log.Printf("Error converting strategy: %s. Expected one of: sequential, roundrobin, leastconn, random, weighted", currentEntryValues[4]);
+                            return nil, nil;
+                        }
+                    }
+
+                    err = loadPortsConfigurationOptions(&portsData, currentEntryOptions[1:]);
+                    if(err != nil) {
+                        log.Printf("Error while reading configuration entry %s: %v", currentEntry, err);
+                        return nil, nil;
                     }
 
                     clusterPort, err = strconv.Atoi(currentEntryValues[0]);
                     if(err != nil) {
-                        log.Printf("Error converting clusterPort: %s. Message: %v", currentEntryValues[1], err);
-                        os.Exit(1);
+                        log.Printf("Error converting clusterPort: %s. Message: %v", currentEntryValues[0], err);
+                        return nil, nil;
                     }
-                    portsDataList[lineSplitIndex] = portsData;
+                    data[clusterPort] = append(data[clusterPort], portsData);
                 }
             }
-
-            data[clusterPort] = portsDataList;
         }
 
         // In case of error during Scan(), expect to catch error here
@@ -351,140 +615,1053 @@ func loadPortsConfiguration(cfgFilePath string) (PortsConfigurationMap) {
         err = scanner.Err();
         if(err != nil) {
             log.Printf("Error reading from file: %v", err);
-            os.Exit(1);
+            return nil, nil;
+        }
+
+        // Only the first strategy of a cluster port applies, report entries setting another one
+        var strategyClusterPort int;
+        var strategyPorts []PortsConfigurationData;
+        for strategyClusterPort, strategyPorts = range data {
+            var strategy string = hostPortsStrategy(strategyPorts);
+            var portsData PortsConfigurationData;
+            for _, portsData = range strategyPorts {
+                if(portsData.strategy != "" && portsData.strategy != strategy) {
+                    log.Printf("Warning: cluster port %d has conflicting strategies %s and %s. Using %s for all of its host ports", strategyClusterPort, strategy, portsData.strategy, strategy);
+                }
+            }
         }
 
         // Otherwise, assume data is in good condition
-        return data;
+        return data, clusterPortsData;
     } (cfgFile);
 
     // Return loaded configuration data
-    return portsConfiguration;
+    return portsConfiguration, clusterPortsOptions;
 }
 
 /*============================
- loadHostsConfiguration
+ loadPortsConfigurationOptions
+
+ This procedure parses the extended options of a ports configuration entry.
+ Unknown options are reported and skipped, so that newer configuration files
+ can still be read.
+
+ Options:
+    weight=N: relative share of new connections for the weighted strategy, at least 1.
+              Defaults to maxConnections
+    proxy=v1|v2: proxy protocol version sent when sendProxyFlag is set. Defaults to v1
+    timeout=duration: connect timeout, overriding the cluster port dialTimeout
+    backup=true|false: only route to this host port when no other one is available
+    mirror=true|false: never route to this host port, copy client traffic to it instead
+    check=tcp|http: health check run in the background, unhealthy host ports are skipped
+    checkPath=path: HTTP health check path. Defaults to /
+    checkInterval=duration: time between health checks. Defaults to 5s
+    checkTimeout=duration: health check timeout. Defaults to 1s
+    slowStart=duration: slow-start window of the host port. Defaults to the slowStartWindow setting
+    id=name: identifier of the pod owning the host port
+    strategy=name: same as the positional strategy field
+    rateIn=N, rateOut=N: bandwidth limit of the host port, in bytes per second
 
- This procedure takes the cluster ports proxy configuration file path, opens the file,
- then extracts the file contents and store them into a key-value map.
+ Parameters:
+    portsData: ports configuration entry being loaded
+    options: list of key=value options
 
- Base configuration entry format:
-    ipA:32767
-    ipB:32767
+ Returns:
+    Error on invalid option values
+============================*/
+func loadPortsConfigurationOptions(portsData *PortsConfigurationData, options []string) (error) {
+    var option string;
+    for _, option = range options {
+        if(option == "") {
+            continue;
+        }
+        var optionValues []string = strings.SplitN(option, "=", 2);
+        if(len(optionValues) != 2) {
+            log.Printf("Skipping malformed ports configuration option: %s. Expected format: key=value", option);
+            continue;
+        }
+        var err error;
+        var key string = optionValues[0];
+        var value string = optionValues[1];
+        switch key {
+            case "weight":
+                portsData.weight, err = strconv.Atoi(value);
+                if(err != nil || portsData.weight < 1) {
+                    return fmt.Errorf("error converting weight: %s. Expected a positive integer. Message: %v", value, err);
+                }
+            case "proxy":
+                switch value {
+                    case "v1":
+                        portsData.proxyVersion = 1;
+                    case "v2":
+                        portsData.proxyVersion = 2;
+                    default:
+                        return fmt.Errorf("error converting proxy: %s. Expected one of: v1, v2", value);
+                }
+            case "timeout":
+                portsData.connectTimeout, err = time.ParseDuration(value);
+                if(err != nil || portsData.connectTimeout < 0) {
+                    return fmt.Errorf("error converting timeout: %s. Message: %v", value, err);
+                }
+            case "backup":
+                portsData.backup, err = strconv.ParseBool(value);
+                if(err != nil) {
+                    return fmt.Errorf("error converting backup: %s. Message: %v", value, err);
+                }
+            case "mirror":
+                portsData.mirror, err = strconv.ParseBool(value);
+                if(err != nil) {
+                    return fmt.Errorf("error converting mirror: %s. Message: %v", value, err);
+                }
+            case "check":
+                if(value != "tcp" && value != "http") {
+                    return fmt.Errorf("error converting check: %s. Expected one of: tcp, http", value);
+                }
+                portsData.check = value;
+            case "checkPath":
+                portsData.checkPath = value;
+            case "checkInterval":
+                portsData.checkInterval, err = time.ParseDuration(value);
+                if(err != nil || portsData.checkInterval <= 0) {
+                    return fmt.Errorf("error converting checkInterval: %s. Message: %v", value, err);
+                }
+            case "checkTimeout":
+                portsData.checkTimeout, err = time.ParseDuration(value);
+                if(err != nil || portsData.checkTimeout <= 0) {
+                    return fmt.Errorf("error converting checkTimeout: %s. Message: %v", value, err);
+                }
+            case "slowStart":
+                portsData.slowStart, err = time.ParseDuration(value);
+                if(err != nil || portsData.slowStart < 0) {
+                    return fmt.Errorf("error converting slowStart: %s. Message: %v", value, err);
+                }
+            case "rateIn":
+                portsData.rateIn, err = parseByteRate(key, value);
+                if(err != nil) {
+                    return err;
+                }
+            case "rateOut":
+                portsData.rateOut, err = parseByteRate(key, value);
+                if(err != nil) {
+                    return err;
+                }
+            case "id":
+                portsData.podId = value;
+            case "strategy":
+                if(!isHostPortsStrategy(value)) {
+                    return fmt.Errorf("error converting strategy: %s. Expected one of: sequential, roundrobin, leastconn, random, weighted", value);
+                }
+                portsData.strategy = value;
+            default:
+                log.Printf("Skipping unknown ports configuration option: %s", option);
+        }
+    }
+    return nil;
+}
+
+/*============================
+ loadClusterPortOptions
+
+ This procedure parses the options of a cluster port entry, made of a cluster port
+ alone followed by its options. Those apply to the cluster port listener, whatever
+ host ports the cluster port has on this host.
+
+ Options:
+    rateIn=N: bandwidth limit of the cluster port from clients, in bytes per second
+    rateOut=N: bandwidth limit of the cluster port to clients, in bytes per second
 
  Configuration example:
-    192.168.10.20:32767
-    192.168.10.30:32767
-    192.168.10.40:32767
+    29999;rateIn=1000000;rateOut=5000000
 
  Parameters:
-    cfgFilePath: local path to configuration file
+    clusterPortOptions: cluster port options being loaded
+    options: list of key=value options
 
  Returns:
-    Loaded hosts configuration map
+    Error on invalid option values
 ============================*/
-func loadHostsConfiguration(cfgFilePath string) (HostsConfigurationMap) {
-    // Open configuration file
-    var cfgFile = func(filePath string) (*os.File) {
-        file, err := os.Open(filePath);
+func loadClusterPortOptions(clusterPortOptions *ClusterPortOptions, options []string) (error) {
+    var option string;
+    for _, option = range options {
+        if(option == "") {
+            continue;
+        }
+        var optionValues []string = strings.SplitN(option, "=", 2);
+        if(len(optionValues) != 2) {
+            log.Printf("Skipping malformed cluster port option: %s. Expected format: key=value", option);
+            continue;
+        }
+        var err error;
+        switch optionValues[0] {
+            case "rateIn":
+                clusterPortOptions.rateIn, err = parseByteRate(optionValues[0], optionValues[1]);
+            case "rateOut":
+                clusterPortOptions.rateOut, err = parseByteRate(optionValues[0], optionValues[1]);
+            default:
+                log.Printf("Skipping unknown cluster port option: %s", option);
+        }
         if(err != nil) {
-            log.Printf("Error opening file %s for reading\n%v", filePath, err);
-            os.Exit(1);
+            return err;
         }
-        return file;
-    } (cfgFilePath);
-    defer cfgFile.Close();
+    }
+    return nil;
+}
 
-    // Extract data from configuration file
-    var hostsConfiguration = func(file *os.File) (HostsConfigurationMap) {
-        var data = make(HostsConfigurationMap);
-        var scanner *bufio.Scanner = bufio.NewScanner(file);
+/*============================
+ parseByteRate
 
-        // Try to iterate over all file contents
-        for scanner.Scan() {
-            // Read line
-            var line string;
-            line = scanner.Text();
-            log.Printf("Configuration line: %s\n", line);
+ This procedure parses a bandwidth limit option.
 
-            // Iterate over all entries
-            var currentEntry string = line;
-            var currentEntryValues []string = strings.Split(currentEntry, ":");
-            var currentEntryValuesLen int = len(currentEntryValues);
-            if(currentEntryValuesLen != 2) {
-                log.Printf("Error while reading configuration line: %s. Expected format: ip:port. Values: %s. Length: %d", currentEntry, currentEntryValues,  currentEntryValuesLen);
-                os.Exit(1);
-            } else {
-                log.Printf("Parsing configuration entry: %s\n", currentEntry);
-                var err error;
-                var hostIp string;
-                var hostPort int;
-                hostIp = currentEntryValues[0];
-                hostPort, err = strconv.Atoi(currentEntryValues[1]);
-                if(err != nil) {
-                    log.Printf("Error converting hostPort: %s. Message: %v", currentEntryValues[1], err);
-                    os.Exit(1);
-                }
-                data[hostIp] = hostPort;
-            }
+ Parameters:
+    key: option name
+    value: option value, in bytes per second
+
+ Returns:
+    Bandwidth limit, 0 meaning unlimited
+    Error on invalid values
+============================*/
+func parseByteRate(key string, value string) (int64, error) {
+    var rate, err = strconv.ParseInt(value, 10, 64);
+    if(err != nil || rate < 0) {
+        return 0, fmt.Errorf("error converting %s: %s. Expected a non-negative number of bytes per second. Message: %v", key, value, err);
+    }
+    return rate, nil;
+}
+
+/*============================
+ hostPortWeight
+
+ This procedure returns the relative share of new connections given to a host port
+ by the weighted strategy: its configured weight, or its maxConnections when unset.
+
+ Parameters:
+    portsData: ports configuration entry
+
+ Returns:
+    Host port weight
+============================*/
+func hostPortWeight(portsData PortsConfigurationData) (int) {
+    if(portsData.weight > 0) {
+        return portsData.weight;
+    }
+    return portsData.maxConnections;
+}
+
+/*============================
+ writeProxyHeader
+
+ This procedure writes a proxy protocol header to a host connection, either as
+ a version 1 text line or as a version 2 binary header.
+ Reference: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+ Parameters:
+    writer: host connection
+    version: proxy protocol version, 1 or 2
+    clientIp: source address
+    proxyIp: destination address
+    clientPort: source port
+    proxyPort: destination port
 
+ Returns:
+    Error, if any
+============================*/
+func writeProxyHeader(writer io.Writer, version int, clientIp string, proxyIp string, clientPort int, proxyPort int) (error) {
+    var sourceIp net.IP = net.ParseIP(clientIp);
+    var destinationIp net.IP = net.ParseIP(proxyIp);
+    var isIPv4 bool = sourceIp != nil && destinationIp != nil && sourceIp.To4() != nil && destinationIp.To4() != nil;
+    var err error;
+
+    if(version != 2) {
+        var proxyLine string;
+        if(sourceIp == nil || destinationIp == nil) {
+            proxyLine = "PROXY UNKNOWN\r\n";
+        } else if(isIPv4) {
+            proxyLine = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", clientIp, proxyIp, clientPort, proxyPort);
+        } else {
+            proxyLine = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", clientIp, proxyIp, clientPort, proxyPort);
         }
+        _, err = io.WriteString(writer, proxyLine);
+        return err;
+    }
 
-        // In case of error during Scan(), expect to catch error here
-        var err error = nil;
-        err = scanner.Err();
-        if(err != nil) {
-            log.Printf("Error reading from file: %v", err);
-            os.Exit(1);
+    const proxyProtocolV2Signature string = "\r\n\r\n\x00\r\nQUIT\n";
+    var header bytes.Buffer;
+    header.WriteString(proxyProtocolV2Signature);
+    if(sourceIp == nil || destinationIp == nil) {
+        // LOCAL command, no address block
+        header.Write([]byte{0x20, 0x00, 0x00, 0x00});
+    } else {
+        var addresses bytes.Buffer;
+        var family byte;
+        if(isIPv4) {
+            family = 0x11;
+            addresses.Write(sourceIp.To4());
+            addresses.Write(destinationIp.To4());
+        } else {
+            family = 0x21;
+            addresses.Write(sourceIp.To16());
+            addresses.Write(destinationIp.To16());
         }
+        addresses.Write([]byte{byte(clientPort >> 8), byte(clientPort), byte(proxyPort >> 8), byte(proxyPort)});
+        header.Write([]byte{0x21, family, byte(addresses.Len() >> 8), byte(addresses.Len())});
+        header.Write(addresses.Bytes());
+    }
+    _, err = writer.Write(header.Bytes());
+    return err;
+}
 
-        // Otherwise, assume data is in good condition
-        return data;
-    } (cfgFile);
+/*============================
+ readHeaderLine
 
-    // Return loaded configuration data
-    return hostsConfiguration;
-}
+ This procedure reads a header line, up to and including its "\n", without ever
+ buffering more than the maximum header length. Reads are bounded in time by the
+ connection deadline.
 
-func loadProgramSettings(cfgFilePath string) (ProgramSettings) {
-    // Open configuration file
-    var cfgFile = func(filePath string) (*os.File) {
-        file, err := os.Open(filePath);
+ Parameters:
+    reader: connection reader, positioned at the start of the line
+    maxLength: maximum line length, "\n" included
+
+ Returns:
+    Header line, and errHeaderTooLong when no line ends within the maximum length
+============================*/
+func readHeaderLine(reader *bufio.Reader, maxLength int) (string, error) {
+    for {
+        var buffered, _ = reader.Peek(reader.Buffered());
+        var index int = bytes.IndexByte(buffered, '\n');
+        if(index >= 0 && index < maxLength) {
+            var line string = string(buffered[:index + 1]);
+            reader.Discard(index + 1);
+            return line, nil;
+        }
+        if(index >= 0 || len(buffered) >= maxLength) {
+            return "", errHeaderTooLong;
+        }
+        // Wait for more header bytes
+        var _, err = reader.Peek(len(buffered) + 1);
         if(err != nil) {
-            log.Printf("Error opening file %s for reading\n%v", filePath, err);
-            os.Exit(1);
+            return "", err;
         }
-        return file;
-    } (cfgFilePath);
-    defer cfgFile.Close();
+    }
+}
 
-    // Extract data from configuration file
-    var programSettings = func(file *os.File) (ProgramSettings) {
-        var data ProgramSettings;
-        var scanner *bufio.Scanner = bufio.NewScanner(file);
+/*============================
+ hasProxyProtocolPrefix
 
-        // Try to iterate over all file contents
-        for scanner.Scan() {
-            // Read line
-            var line string;
-            line = scanner.Text();
-            log.Printf("Program settings line: %s\n", line);
+ This procedure checks whether client data starts with a proxy protocol header,
+ leaving client data unread. It waits for the first client bytes, and for the rest
+ of a header prefix sent in several parts.
 
-            // Iterate over all entries
-            var currentEntry string = line;
-            var currentEntryValues []string = strings.Split(currentEntry, "=");
-            var currentEntryValuesLen int = len(currentEntryValues);
-            if(currentEntryValuesLen != 2) {
-                log.Printf("Error while reading program settings line: %s. Expected format: setting:value. Values: %s. Length: %d", currentEntry, currentEntryValues, currentEntryValuesLen);
-                os.Exit(1);
-            } else {
-                log.Printf("Parsing program settings entry: %s\n", currentEntry);
-                var err error;
-                var setting string;
-                var value string;
-                setting = currentEntryValues[0];
-                value = strings.Trim(currentEntryValues[1], "\"");
-                switch setting {
+ Parameters:
+    reader: connection reader, positioned at the start of client data
+
+ Returns:
+    True when client data starts with "PROXY ", and read error if any
+============================*/
+func hasProxyProtocolPrefix(reader *bufio.Reader) (bool, error) {
+    const proxyProtocolHeaderString string = "PROXY ";
+    const proxyProtocolHeaderStringLen int = len(proxyProtocolHeaderString);
+    var _, err = reader.Peek(1);
+    if(err != nil) {
+        return false, err;
+    }
+    var available int = reader.Buffered();
+    if(available > proxyProtocolHeaderStringLen) {
+        available = proxyProtocolHeaderStringLen;
+    }
+    var buffer []byte;
+    buffer, err = reader.Peek(available);
+    // Wait for the rest of a header prefix sent in several parts
+    if(err == nil && available < proxyProtocolHeaderStringLen && bytes.HasPrefix([]byte(proxyProtocolHeaderString), buffer)) {
+        buffer, err = reader.Peek(proxyProtocolHeaderStringLen);
+    }
+    return err == nil && bytes.Equal(buffer, []byte(proxyProtocolHeaderString)), err;
+}
+
+/*============================
+ Read
+
+ This procedure reads client data from a source not trusted to send proxy protocol
+ headers. Such connections are proxied without waiting for client data, so the
+ header check is done on the first read instead: a connection starting with a
+ header fails with errUntrustedHeader before any byte reaches the host.
+
+ Parameters:
+    data: destination buffer
+
+ Returns:
+    Number of bytes read, and read error if any
+============================*/
+func (guard *ProxyHeaderGuard) Read(data []byte) (int, error) {
+    if(!guard.checked) {
+        guard.checked = true;
+        var found, _ = hasProxyProtocolPrefix(guard.reader);
+        if(found) {
+            guard.rejected = true;
+            return 0, errUntrustedHeader;
+        }
+    }
+    return guard.reader.Read(data);
+}
+
+/*============================
+ headerErrorReason
+
+ This procedure returns the metrics reason of a rejected header.
+
+ Parameters:
+    err: header parsing error, nil when the header was malformed
+
+ Returns:
+    One of: header_timeout, header_too_long, header_invalid
+============================*/
+func headerErrorReason(err error) (string) {
+    var netError, isNetError = err.(net.Error);
+    if(isNetError && netError.Timeout()) {
+        return "header_timeout";
+    }
+    if(err == errHeaderTooLong) {
+        return "header_too_long";
+    }
+    return "header_invalid";
+}
+
+/*============================
+ formatInternalHeader
+
+ This procedure formats the internal header sent by the cluster ports proxy to the
+ local ports proxy of another host. It carries, as distinct fields, the cluster port
+ to route to, the client and destination addresses, and the proxy protocol header
+ received from the client, if any. The header ends with an empty line.
+
+ Internal header format:
+    CP=29999
+    SRC=192.168.0.1 56324
+    DST=192.168.0.11 443
+    PP=PROXY TCP4 192.168.0.1 192.168.0.11 56324 443
+
+ Parameters:
+    header: internal header fields
+
+ Returns:
+    Formatted internal header
+============================*/
+func formatInternalHeader(header InternalHeader) (string) {
+    var text string = fmt.Sprintf("CP=%d\nSRC=%s %d\nDST=%s %d\n", header.clusterPort, header.clientIp, header.clientPort, header.proxyIp, header.proxyPort);
+    if(header.proxyHeader != "") {
+        text += "PP=" + header.proxyHeader + "\n";
+    }
+    return text + "\n";
+}
+
+/*============================
+ readInternalHeader
+
+ This procedure reads an internal header, see formatInternalHeader. Unknown fields
+ are ignored, so that fields can be added later on. The whole header is bounded by
+ maxInternalHeaderLength.
+
+ Parameters:
+    reader: connection reader, positioned at the start of the header
+
+ Returns:
+    Internal header fields, raw header text, and error on malformed headers
+============================*/
+func readInternalHeader(reader *bufio.Reader) (InternalHeader, string, error) {
+    const maxInternalHeaderLines int = 16;
+    var header InternalHeader;
+    var text string;
+    var lineCount int;
+    for lineCount = 0; lineCount < maxInternalHeaderLines; lineCount++ {
+        line, err := readHeaderLine(reader, maxInternalHeaderLength - len(text));
+        if(err != nil) {
+            return header, text, err;
+        }
+        text += line;
+        line = strings.TrimRight(line, "\r\n");
+        if(line == "") {
+            if(header.clusterPort <= 0 || header.clientIp == "") {
+                return header, text, fmt.Errorf("missing CP or SRC field");
+            }
+            return header, text, nil;
+        }
+
+        var fieldValues []string = strings.SplitN(line, "=", 2);
+        if(len(fieldValues) != 2) {
+            return header, text, fmt.Errorf("malformed field %q", line);
+        }
+        var addressValues []string = strings.Fields(fieldValues[1]);
+        switch fieldValues[0] {
+            case "CP":
+                header.clusterPort, err = strconv.Atoi(fieldValues[1]);
+            case "SRC", "DST":
+                if(len(addressValues) != 2 || net.ParseIP(addressValues[0]) == nil) {
+                    return header, text, fmt.Errorf("malformed address %q", line);
+                }
+                var port int;
+                port, err = strconv.Atoi(addressValues[1]);
+                if(fieldValues[0] == "SRC") {
+                    header.clientIp, header.clientPort = addressValues[0], port;
+                } else {
+                    header.proxyIp, header.proxyPort = addressValues[0], port;
+                }
+            case "PP":
+                if(!strings.HasPrefix(fieldValues[1], "PROXY ")) {
+                    return header, text, fmt.Errorf("malformed proxy protocol header %q", line);
+                }
+                header.proxyHeader = fieldValues[1];
+        }
+        if(err != nil) {
+            return header, text, fmt.Errorf("malformed field %q", line);
+        }
+    }
+    return header, text, fmt.Errorf("too many fields");
+}
+
+/*============================
+ connectionAddresses
+
+ This procedure returns the addresses of both ends of a connection, as used in
+ proxy protocol headers.
+
+ Parameters:
+    connection: accepted connection
+
+ Returns:
+    Remote IP, local IP, remote port and local port
+============================*/
+func connectionAddresses(connection net.Conn) (string, string, int, int) {
+    var remoteIp, remotePortString, _ = net.SplitHostPort(connection.RemoteAddr().String());
+    var localIp, localPortString, _ = net.SplitHostPort(connection.LocalAddr().String());
+    var remotePort, _ = strconv.Atoi(remotePortString);
+    var localPort, _ = strconv.Atoi(localPortString);
+    return remoteIp, localIp, remotePort, localPort;
+}
+
+/*============================
+ isHostPortsStrategy
+
+ This procedure checks whether a name is a known host ports load balancing strategy.
+
+ Parameters:
+    strategy: strategy name
+
+ Returns:
+    True when the strategy is known, false otherwise
+============================*/
+func isHostPortsStrategy(strategy string) (bool) {
+    switch strategy {
+        case "sequential", "roundrobin", "leastconn", "random", "weighted":
+            return true;
+    }
+    return false;
+}
+
+/*============================
+ hostPortsStrategy
+
+ This procedure returns the load balancing strategy of a cluster port,
+ which is the first strategy set among its entries. When no strategy is set
+ but some entry has an explicit weight, weights are honoured.
+
+ Parameters:
+    ports: cluster port entries
+
+ Returns:
+    Strategy name. Defaults to sequential
+============================*/
+func hostPortsStrategy(ports []PortsConfigurationData) (string) {
+    var portsData PortsConfigurationData;
+    var hasWeight bool = false;
+    for _, portsData = range ports {
+        if(portsData.strategy != "") {
+            return portsData.strategy;
+        }
+        if(portsData.weight > 0) {
+            hasWeight = true;
+        }
+    }
+    if(hasWeight) {
+        return "weighted";
+    }
+    return "sequential";
+}
+
+/*============================
+ loadAccessControl
+
+ This procedure reads the client access control rules of cluster ports.
+
+ Entry format, one rule per line:
+    clusterPort:allow:cidrs
+    clusterPort:deny:cidrs
+
+ Where cidrs is a comma separated list of CIDRs or single addresses. Empty lines and
+ lines starting with "#" are skipped. Cluster ports without rules accept all clients.
+
+ Configuration example:
+    27017:allow:10.0.0.0/8,192.168.1.10
+    27017:deny:10.0.99.0/24
+    8080:deny:0.0.0.0/0,::/0
+
+ Parameters:
+    cfgFilePath: local path to access control file
+
+ Returns:
+    Loaded access control map, and error on invalid files
+============================*/
+func loadAccessControl(cfgFilePath string) (AccessControlMap, error) {
+    var content, err = ioutil.ReadFile(cfgFilePath);
+    if(err != nil) {
+        return nil, err;
+    }
+
+    var data = make(AccessControlMap);
+    var line string;
+    for _, line = range strings.Split(string(content), "\n") {
+        line = strings.TrimSpace(line);
+        if(line == "" || strings.HasPrefix(line, "#")) {
+            continue;
+        }
+
+        // IPv6 CIDRs hold colons themselves, so only split the first two fields
+        var fields []string = strings.SplitN(line, ":", 3);
+        if(len(fields) != 3) {
+            return nil, fmt.Errorf("invalid rule %s. Expected format: clusterPort:allow|deny:cidrs", line);
+        }
+        var clusterPort int;
+        clusterPort, err = strconv.Atoi(fields[0]);
+        if(err != nil) {
+            return nil, fmt.Errorf("invalid cluster port in rule %s", line);
+        }
+        var cidrs []*net.IPNet;
+        cidrs, err = parseCidrs(fields[2]);
+        if(err != nil) {
+            return nil, fmt.Errorf("invalid CIDRs in rule %s: %v", line, err);
+        }
+        if(data[clusterPort] == nil) {
+            data[clusterPort] = &AccessControlData{};
+        }
+        switch fields[1] {
+            case "allow":
+                data[clusterPort].allow = append(data[clusterPort].allow, cidrs...);
+            case "deny":
+                data[clusterPort].deny = append(data[clusterPort].deny, cidrs...);
+            default:
+                return nil, fmt.Errorf("invalid action in rule %s. Expected one of: allow, deny", line);
+        }
+    }
+    return data, nil;
+}
+
+/*============================
+ isClientAllowed
+
+ This procedure checks the access control rules of a cluster port against a client
+ address. Deny rules take precedence. When the cluster port has allow rules, the
+ client must match one of them.
+
+ Parameters:
+    accessControl: access control rules, nil when disabled
+    clusterPort: cluster port the client connects to
+    clientIp: effective client IP
+
+ Returns:
+    True when the client is allowed
+============================*/
+func isClientAllowed(accessControl AccessControlMap, clusterPort int, clientIp string) (bool) {
+    var rules *AccessControlData = accessControl[clusterPort];
+    if(rules == nil) {
+        return true;
+    }
+    var ip net.IP = net.ParseIP(clientIp);
+    if(ip == nil) {
+        return false;
+    }
+    var cidr *net.IPNet;
+    for _, cidr = range rules.deny {
+        if(cidr.Contains(ip)) {
+            return false;
+        }
+    }
+    if(len(rules.allow) == 0) {
+        return true;
+    }
+    for _, cidr = range rules.allow {
+        if(cidr.Contains(ip)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+/*============================
+ loadHostsConfiguration
+
+ This procedure takes the cluster ports proxy configuration file path, opens the file,
+ then extracts the file contents and store them into a key-value map.
+
+ Base configuration entry format:
+    ipA:32767 [zone=zoneName] [weight=N] [name=hostName]
+    [ipv6B]:32767 [zone=zoneName] [weight=N] [name=hostName]
+    hostnameC:32767 [zone=zoneName] [weight=N] [name=hostName]
+
+ The trailing metadata fields are optional. When omitted, the host has no zone,
+ a weight of 1 and is named after its address.
+
+ Hosts are keyed by their full host:port endpoint, so several proxies may share
+ the same address. Duplicated endpoints are reported and only the first one is kept.
+ The line order is recorded in each entry so that it can be restored later.
+
+ Configuration example:
+    192.168.10.20:32767
+    192.168.10.30:32767 zone=eu-1a weight=3 name=node3
+    192.168.10.40:32767 zone=eu-1b name=node4
+    [fd00::1]:32767
+    node5.cluster.local:32767 zone=eu-1b
+
+ Parameters:
+    cfgFilePath: local path to configuration file
+
+ Returns:
+    Loaded hosts configuration map
+============================*/
+func loadHostsConfiguration(cfgFilePath string) (HostsConfigurationMap) {
+    // Open configuration file
+    var cfgFile = func(filePath string) (*os.File) {
+        file, err := os.Open(filePath);
+        if(err != nil) {
+            log.Printf("Error opening file %s for reading\n%v", filePath, err);
+            os.Exit(1);
+        }
+        return file;
+    } (cfgFilePath);
+    defer cfgFile.Close();
+
+    // Extract data from configuration file
+    var hostsConfiguration = func(file *os.File) (HostsConfigurationMap) {
+        var data = make(HostsConfigurationMap);
+        var scanner *bufio.Scanner = bufio.NewScanner(file);
+        var index int = 0;
+
+        // Try to iterate over all file contents
+        for scanner.Scan() {
+            // Read line
+            var line string;
+            line = scanner.Text();
+            log.Printf("Configuration line: %s\n", line);
+
+            // Split address from trailing metadata fields
+            var lineFields []string = strings.Fields(line);
+            if(len(lineFields) < 1) {
+                log.Printf("Error while reading configuration line: %s. Expected format: host:port [zone=zoneName] [weight=N] [name=hostName]", line);
+                os.Exit(1);
+            }
+
+            // Iterate over all entries
+            var currentEntry string = lineFields[0];
+            var currentEntryHost, currentEntryPort, currentEntryErr = net.SplitHostPort(currentEntry);
+            if(currentEntryErr != nil || currentEntryHost == "") {
+                log.Printf("Error while reading configuration line: %s. Expected format: host:port or [ipv6]:port. Message: %v", currentEntry, currentEntryErr);
+                os.Exit(1);
+            } else {
+                log.Printf("Parsing configuration entry: %s\n", currentEntry);
+                var err error;
+                var hostData HostsConfigurationData;
+                hostData.host = currentEntryHost;
+                hostData.port, err = strconv.Atoi(currentEntryPort);
+                if(err != nil) {
+                    log.Printf("Error converting hostPort: %s. Message: %v", currentEntryPort, err);
+                    os.Exit(1);
+                }
+                hostData.weight = 1;
+
+                // Read metadata fields
+                var metadataField string;
+                for _, metadataField = range lineFields[1:] {
+                    var metadataValues []string = strings.SplitN(metadataField, "=", 2);
+                    if(len(metadataValues) != 2) {
+                        log.Printf("Error while reading configuration metadata: %s. Expected format: key=value", metadataField);
+                        os.Exit(1);
+                    }
+                    switch metadataValues[0] {
+                        case "zone":
+                            hostData.zone = metadataValues[1];
+                        case "name":
+                            hostData.name = metadataValues[1];
+                        case "weight":
+                            hostData.weight, err = strconv.Atoi(metadataValues[1]);
+                            if(err != nil || hostData.weight < 1) {
+                                log.Printf("Error converting weight: %s. Expected a positive integer. Message: %v", metadataValues[1], err);
+                                os.Exit(1);
+                            }
+                        default:
+                            log.Printf("Skipping unknown metadata field: %s", metadataField);
+                    }
+                }
+
+                var endpoint string = net.JoinHostPort(hostData.host, strconv.Itoa(hostData.port));
+                var _, duplicated = data[endpoint];
+                if(duplicated) {
+                    log.Printf("Duplicated hosts configuration entry: %s. Keeping first occurrence...", endpoint);
+                    continue;
+                }
+                hostData.index = index;
+                index++;
+                data[endpoint] = hostData;
+            }
+
+        }
+
+        // In case of error during Scan(), expect to catch error here
+        var err error = nil;
+        err = scanner.Err();
+        if(err != nil) {
+            log.Printf("Error reading from file: %v", err);
+            os.Exit(1);
+        }
+
+        // Otherwise, assume data is in good condition
+        return data;
+    } (cfgFile);
+
+    // Return loaded configuration data
+    return hostsConfiguration;
+}
+
+/*============================
+ hostLabel
+
+ This procedure returns a human readable label for a host, preferring its
+ configured name over its raw address.
+
+ Parameters:
+    hostData: host configuration entry
+
+ Returns:
+    Host label to be used in logs
+============================*/
+func hostLabel(hostData HostsConfigurationData) (string) {
+    var address string = net.JoinHostPort(hostData.host, strconv.Itoa(hostData.port));
+    if(hostData.address != "" && hostData.address != hostData.host) {
+        address = address + " via " + hostData.address;
+    }
+    if(hostData.name == "") {
+        return address;
+    }
+    return hostData.name + " (" + address + ")";
+}
+
+/*============================
+ resolve
+
+ This procedure returns all addresses known for a configured host.
+ IP literals are returned as is. Host names are only served from the resolver
+ cache, filled by refresh, so that connections never wait for DNS lookups.
+
+ Parameters:
+    host: configured host, either an IP literal or a DNS name
+
+ Returns:
+    List of addresses. Empty when the host name is not resolved (yet)
+============================*/
+func (resolver *HostsResolver) resolve(host string) ([]string) {
+    if(net.ParseIP(host) != nil) {
+        return []string{host};
+    }
+
+    resolver.lock.RLock();
+    defer resolver.lock.RUnlock();
+    return resolver.addresses[host];
+}
+
+/*============================
+ refresh
+
+ This procedure resolves all host names in the hosts configuration and drops
+ cached names which are no longer configured. On lookup failure, the previously
+ known addresses are kept.
+
+ Parameters:
+    hostsConfiguration: loaded hosts configuration map
+============================*/
+func (resolver *HostsResolver) refresh(hostsConfiguration HostsConfigurationMap) {
+    var addresses = make(map[string][]string);
+    var hostData HostsConfigurationData;
+    for _, hostData = range hostsConfiguration {
+        if(net.ParseIP(hostData.host) != nil) {
+            continue;
+        }
+        var resolvedAddresses, err = net.LookupHost(hostData.host);
+        if(err != nil) {
+            log.Printf("Error resolving host %s: %v", hostData.host, err);
+            resolver.lock.RLock();
+            resolvedAddresses = resolver.addresses[hostData.host];
+            resolver.lock.RUnlock();
+        }
+        if(resolvedAddresses != nil) {
+            addresses[hostData.host] = resolvedAddresses;
+        }
+    }
+
+    resolver.lock.Lock();
+    resolver.addresses = addresses;
+    resolver.lock.Unlock();
+}
+
+/*============================
+ expandHostsAddresses
+
+ This procedure turns an ordered list of hosts into an ordered list of dial
+ candidates, one per resolved address. Hosts which do not resolve are skipped.
+
+ Parameters:
+    hosts: ordered list of hosts
+    resolver: hosts resolver
+
+ Returns:
+    Ordered list of hosts with their address set
+============================*/
+func expandHostsAddresses(hosts []HostsConfigurationData, resolver *HostsResolver) ([]HostsConfigurationData) {
+    var candidates []HostsConfigurationData;
+    var hostData HostsConfigurationData;
+    for _, hostData = range hosts {
+        var address string;
+        for _, address = range resolver.resolve(hostData.host) {
+            var candidate HostsConfigurationData = hostData;
+            candidate.address = address;
+            candidates = append(candidates, candidate);
+        }
+    }
+    return candidates;
+}
+
+/*============================
+ orderHostsByTopology
+
+ This procedure returns the order in which hosts should be tried for a new connection.
+ Hosts in the same zone as the local proxy come first, followed by all other hosts.
+ Within each group, hosts are either drawn at random proportionally to their weight
+ ("weighted", default) or kept in the same order as in the configuration file ("ordered").
+
+ Parameters:
+    hostsConfiguration: loaded hosts configuration map
+    localZone: zone of the local proxy. Empty when topology is not in use
+    selection: hosts selection strategy
+
+ Returns:
+    Ordered list of hosts
+============================*/
+func orderHostsByTopology(hostsConfiguration HostsConfigurationMap, localZone string, selection string) ([]HostsConfigurationData) {
+    var localHosts []HostsConfigurationData;
+    var remoteHosts []HostsConfigurationData;
+    var hostData HostsConfigurationData;
+    for _, hostData = range hostsConfiguration {
+        if(localZone != "" && hostData.zone == localZone) {
+            localHosts = append(localHosts, hostData);
+        } else {
+            remoteHosts = append(remoteHosts, hostData);
+        }
+    }
+
+    // Restore configuration file order
+    sort.Slice(localHosts, func(i int, j int) (bool) { return localHosts[i].index < localHosts[j].index; });
+    sort.Slice(remoteHosts, func(i int, j int) (bool) { return remoteHosts[i].index < remoteHosts[j].index; });
+    if(selection == "ordered") {
+        return append(localHosts, remoteHosts...);
+    }
+
+    // Weighted draw without replacement
+    var weightedShuffle = func(hosts []HostsConfigurationData) ([]HostsConfigurationData) {
+        var shuffled []HostsConfigurationData = make([]HostsConfigurationData, 0, len(hosts));
+        var totalWeight int = 0;
+        for _, hostData = range hosts {
+            totalWeight += hostData.weight;
+        }
+        for len(hosts) > 0 {
+            var pick int = rand.Intn(totalWeight);
+            var index int;
+            for index = 0; index < len(hosts); index++ {
+                pick -= hosts[index].weight;
+                if(pick < 0) {
+                    break;
+                }
+            }
+            totalWeight -= hosts[index].weight;
+            shuffled = append(shuffled, hosts[index]);
+            hosts = append(hosts[:index], hosts[index+1:]...);
+        }
+        return shuffled;
+    };
+
+    return append(weightedShuffle(localHosts), weightedShuffle(remoteHosts)...);
+}
+
+func loadProgramSettings(cfgFilePath string) (ProgramSettings) {
+    // Open configuration file
+    var cfgFile = func(filePath string) (*os.File) {
+        file, err := os.Open(filePath);
+        if(err != nil) {
+            log.Printf("Error opening file %s for reading\n%v", filePath, err);
+            os.Exit(1);
+        }
+        return file;
+    } (cfgFilePath);
+    defer cfgFile.Close();
+
+    // Extract data from configuration file
+    var programSettings = func(file *os.File) (ProgramSettings) {
+        var data ProgramSettings;
+        var scanner *bufio.Scanner = bufio.NewScanner(file);
+        data.timeouts = TimeoutSettings{
+            dialTimeout: 1 * time.Second,
+            handshakeTimeout: 5 * time.Second,
+            proxyHeaderTimeout: 5 * time.Second,
+            idleTimeout: 0,
+            maxConnectionLifetime: 0,
+        };
+        data.clusterPortTimeouts = make(map[int]TimeoutSettings);
+        data.clusterPortClientLimits = make(map[int]ClientLimitSettings);
+        data.authMaxClockSkew = 30 * time.Second;
+        data.untrustedProxyHeaders = "reject";
+        data.internalHeader = "cp";
+        data.adminListenerHost = "127.0.0.1";
+        data.outlierConsecutiveFailures = 5;
+        data.outlierBaseEjectionTime = 30 * time.Second;
+        data.outlierMaxEjectionTime = 5 * time.Minute;
+
+        // Try to iterate over all file contents
+        for scanner.Scan() {
+            // Read line
+            var line string;
+            line = scanner.Text();
+            log.Printf("Program settings line: %s\n", line);
+
+            // Skip empty and commented out lines
+            if(len(line) == 0 || line[0] == '#') {
+                continue;
+            }
+
+            // Iterate over all entries
+            var currentEntry string = line;
+            var currentEntryValues []string = strings.Split(currentEntry, "=");
+            var currentEntryValuesLen int = len(currentEntryValues);
+            if(currentEntryValuesLen != 2) {
+                log.Printf("Error while reading program settings line: %s. Expected format: setting:value. Values: %s. Length: %d", currentEntry, currentEntryValues, currentEntryValuesLen);
+                os.Exit(1);
+            } else {
+                log.Printf("Parsing program settings entry: %s\n", currentEntry);
+                var err error;
+                var setting string;
+                var value string;
+                setting = currentEntryValues[0];
+                value = strings.Trim(currentEntryValues[1], "\"");
+                if(loadTimeoutSetting(&data, setting, value)) {
+                    continue;
+                }
+                if(loadClientLimitSetting(&data, setting, value)) {
+                    continue;
+                }
+                switch setting {
                     case "configurationFile":
                         data.configurationFile = value;
                     case "portsConfigurationFile":
@@ -496,43 +1673,2044 @@ func loadProgramSettings(cfgFilePath string) (ProgramSettings) {
                     case "listenerPort":
                         data.listenerPort, err = strconv.Atoi(value);
                         if(err != nil) {
-                            log.Printf("Error converting listenerPort: %s. Message: %v", value, err);
+                            log.Printf("Error converting listenerPort: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "clusterPortsRangeMin":
+                        data.clusterPortsRangeMin, err = strconv.Atoi(value);
+                        if(err != nil) {
+                            log.Printf("Error converting clusterPortsRangeMin: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "clusterPortsRangeMax":
+                        data.clusterPortsRangeMax, err = strconv.Atoi(value);
+                        if(err != nil) {
+                            log.Printf("Error converting clusterPortsRangeMax: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "zone":
+                        data.zone = value;
+                    case "outlierConsecutiveFailures":
+                        data.outlierConsecutiveFailures, err = strconv.Atoi(value);
+                        if(err != nil) {
+                            log.Printf("Error converting outlierConsecutiveFailures: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "outlierBaseEjectionTime":
+                        data.outlierBaseEjectionTime, err = time.ParseDuration(value);
+                        if(err != nil) {
+                            log.Printf("Error converting outlierBaseEjectionTime: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "outlierMaxEjectionTime":
+                        data.outlierMaxEjectionTime, err = time.ParseDuration(value);
+                        if(err != nil) {
+                            log.Printf("Error converting outlierMaxEjectionTime: %s. Message: %v", value, err);
                             os.Exit(1);
                         }
-                    case "clusterPortsRangeMin":
-                        data.clusterPortsRangeMin, err = strconv.Atoi(value);
+                    case "slowStartWindow":
+                        data.slowStartWindow, err = time.ParseDuration(value);
                         if(err != nil) {
-                            log.Printf("Error converting clusterPortsRangeMin: %s. Message: %v", value, err);
+                            log.Printf("Error converting slowStartWindow: %s. Message: %v", value, err);
                             os.Exit(1);
                         }
-                    case "clusterPortsRangeMax":
-                        data.clusterPortsRangeMax, err = strconv.Atoi(value);
+                    case "retryOnEarlyClose":
+                        data.retryOnEarlyClose, err = strconv.ParseBool(value);
                         if(err != nil) {
-                            log.Printf("Error converting clusterPortsRangeMax: %s. Message: %v", value, err);
+                            log.Printf("Error converting retryOnEarlyClose: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "listenerRestrictSources":
+                        data.listenerRestrictSources, err = strconv.ParseBool(value);
+                        if(err != nil) {
+                            log.Printf("Error converting listenerRestrictSources: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "listenerAllowedCidrs":
+                        data.listenerAllowedCidrs, err = parseCidrs(value);
+                        if(err != nil) {
+                            log.Printf("Error converting listenerAllowedCidrs: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "trustedProxyCidrs":
+                        data.trustedProxyCidrs, err = parseCidrs(value);
+                        if(err != nil) {
+                            log.Printf("Error converting trustedProxyCidrs: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "untrustedProxyHeaders":
+                        if(value != "reject" && value != "payload") {
+                            log.Printf("Error converting untrustedProxyHeaders: %s. Expected one of: reject, payload", value);
+                            os.Exit(1);
+                        }
+                        data.untrustedProxyHeaders = value;
+                    case "accessControlFile":
+                        data.accessControlFile = value;
+                    case "internalHeader":
+                        if(value != "cp" && value != "proxy") {
+                            log.Printf("Error converting internalHeader: %s. Expected one of: cp, proxy", value);
+                            os.Exit(1);
+                        }
+                        data.internalHeader = value;
+                    case "authSecretFile":
+                        data.authSecretFile = value;
+                    case "authMaxClockSkew":
+                        data.authMaxClockSkew, err = time.ParseDuration(value);
+                        if(err != nil) {
+                            log.Printf("Error converting authMaxClockSkew: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "tlsCertificateFile":
+                        data.tlsCertificateFile = value;
+                    case "tlsKeyFile":
+                        data.tlsKeyFile = value;
+                    case "tlsCaFile":
+                        data.tlsCaFile = value;
+                    case "replayBufferSize":
+                        data.replayBufferSize, err = strconv.Atoi(value);
+                        if(err != nil) {
+                            log.Printf("Error converting replayBufferSize: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "mirrorBufferSize":
+                        data.mirrorBufferSize, err = strconv.Atoi(value);
+                        if(err != nil) {
+                            log.Printf("Error converting mirrorBufferSize: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "adminListenerHost":
+                        data.adminListenerHost = value;
+                    case "adminListenerPort":
+                        data.adminListenerPort, err = strconv.Atoi(value);
+                        if(err != nil) {
+                            log.Printf("Error converting adminListenerPort: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    case "adminTokenFile":
+                        data.adminTokenFile = value;
+                    case "hostsSelection":
+                        if(value != "" && value != "weighted" && value != "ordered") {
+                            log.Printf("Error converting hostsSelection: %s. Expected one of: weighted, ordered", value);
                             os.Exit(1);
                         }
-                    default:
-                        log.Printf("Skipping unknown entry: %s", value);
+                        data.hostsSelection = value;
+                    case "hostsResolveInterval":
+                        data.hostsResolveInterval, err = time.ParseDuration(value);
+                        if(err != nil) {
+                            log.Printf("Error converting hostsResolveInterval: %s. Message: %v", value, err);
+                            os.Exit(1);
+                        }
+                    default:
+                        log.Printf("Skipping unknown program setting: %s", setting);
+                }
+
+            }
+
+        }
+
+        // In case of error during Scan(), expect to catch error here
+        var err error = nil;
+        err = scanner.Err();
+        if(err != nil) {
+            log.Printf("Error reading from file: %v", err);
+            os.Exit(1);
+        }
+
+        // Otherwise, assume data is in good condition
+        return data;
+    } (cfgFile);
+
+    // Return loaded configuration data
+    return programSettings;
+}
+
+/*============================
+ clusterPortSettingSuffix
+
+ This procedure returns the cluster port a program setting is overridden for, given
+ as a dot suffix of the setting name. Invalid cluster ports, including 0, are fatal
+ rather than silently applied globally or ignored.
+
+ Parameters:
+    setting: setting name, e.g. idleTimeout.29999
+
+ Returns:
+    Cluster port, or 0 when the setting has no suffix
+============================*/
+func clusterPortSettingSuffix(setting string) (int) {
+    var settingValues []string = strings.SplitN(setting, ".", 2);
+    if(len(settingValues) != 2) {
+        return 0;
+    }
+    var clusterPort, err = strconv.Atoi(settingValues[1]);
+    if(err != nil || clusterPort < 1 || clusterPort > 65535) {
+        log.Printf("Error converting %s cluster port: %s. Expected a port between 1 and 65535", settingValues[0], settingValues[1]);
+        os.Exit(1);
+    }
+    return clusterPort;
+}
+
+/*============================
+ loadTimeoutSetting
+
+ This procedure parses a timeout program setting into the program settings.
+ Timeouts are set globally by name, or for a single cluster port by suffixing
+ the name with a dot and the cluster port.
+
+ Setting format:
+    dialTimeout="1s"
+    dialTimeout.29999="500ms"
+
+ Known timeouts: dialTimeout, handshakeTimeout, proxyHeaderTimeout, idleTimeout
+ and maxConnectionLifetime. A zero idle timeout or lifetime disables it.
+
+ Parameters:
+    data: program settings being loaded
+    setting: setting name, possibly suffixed with a cluster port
+    value: setting value
+
+ Returns:
+    True when the setting is a timeout, false otherwise
+============================*/
+func loadTimeoutSetting(data *ProgramSettings, setting string, value string) (bool) {
+    var name string = strings.SplitN(setting, ".", 2)[0];
+    var timeouts *TimeoutSettings = &data.timeouts;
+    var timeout *time.Duration;
+    var clusterPortTimeouts TimeoutSettings;
+    var err error;
+
+    // Leave other settings, dotted or not, to the caller
+    if(name != "dialTimeout" && name != "handshakeTimeout" && name != "proxyHeaderTimeout" && name != "idleTimeout" && name != "maxConnectionLifetime") {
+        return false;
+    }
+
+    // Select cluster port overrides, leaving every other timeout unset
+    var clusterPort int = clusterPortSettingSuffix(setting);
+    if(clusterPort != 0) {
+        var found bool;
+        clusterPortTimeouts, found = data.clusterPortTimeouts[clusterPort];
+        if(!found) {
+            clusterPortTimeouts = TimeoutSettings{-1, -1, -1, -1, -1};
+        }
+        timeouts = &clusterPortTimeouts;
+    }
+
+    switch name {
+        case "dialTimeout":
+            timeout = &timeouts.dialTimeout;
+        case "handshakeTimeout":
+            timeout = &timeouts.handshakeTimeout;
+        case "proxyHeaderTimeout":
+            timeout = &timeouts.proxyHeaderTimeout;
+        case "idleTimeout":
+            timeout = &timeouts.idleTimeout;
+        case "maxConnectionLifetime":
+            timeout = &timeouts.maxConnectionLifetime;
+    }
+
+    *timeout, err = time.ParseDuration(value);
+    if(err != nil || *timeout < 0) {
+        log.Printf("Error converting %s: %s. Message: %v", setting, value, err);
+        os.Exit(1);
+    }
+    if(clusterPort != 0) {
+        data.clusterPortTimeouts[clusterPort] = clusterPortTimeouts;
+    }
+    return true;
+}
+
+/*============================
+ timeoutsForClusterPort
+
+ This procedure returns the timeouts in effect for a cluster port: the global
+ timeouts, overridden by any timeout set for that cluster port.
+
+ Parameters:
+    programSettings: loaded program settings
+    clusterPort: cluster port. Use 0 for the global timeouts
+
+ Returns:
+    Timeouts in effect
+============================*/
+func timeoutsForClusterPort(programSettings ProgramSettings, clusterPort int) (TimeoutSettings) {
+    var timeouts TimeoutSettings = programSettings.timeouts;
+    var overrides, found = programSettings.clusterPortTimeouts[clusterPort];
+    if(!found) {
+        return timeouts;
+    }
+    if(overrides.dialTimeout >= 0) {
+        timeouts.dialTimeout = overrides.dialTimeout;
+    }
+    if(overrides.handshakeTimeout >= 0) {
+        timeouts.handshakeTimeout = overrides.handshakeTimeout;
+    }
+    if(overrides.proxyHeaderTimeout >= 0) {
+        timeouts.proxyHeaderTimeout = overrides.proxyHeaderTimeout;
+    }
+    if(overrides.idleTimeout >= 0) {
+        timeouts.idleTimeout = overrides.idleTimeout;
+    }
+    if(overrides.maxConnectionLifetime >= 0) {
+        timeouts.maxConnectionLifetime = overrides.maxConnectionLifetime;
+    }
+    return timeouts;
+}
+
+/*============================
+ loadClientLimitSetting
+
+ This procedure parses a client limit program setting into the program settings.
+ Like timeouts, limits are set globally by name, or for a single cluster port by
+ suffixing the name with a dot and the cluster port.
+
+ Setting format:
+    clientRateLimit=10
+    clientRateLimit.29999=0.5
+
+ Known limits: clientRateLimit (new connections per second and client IP),
+ clientRateBurst (connections a client may open at once) and clientMaxConnections
+ (active connections per client IP). A zero limit disables it.
+
+ Parameters:
+    data: program settings being loaded
+    setting: setting name, possibly suffixed with a cluster port
+    value: setting value
+
+ Returns:
+    True when the setting is a client limit, false otherwise
+============================*/
+func loadClientLimitSetting(data *ProgramSettings, setting string, value string) (bool) {
+    var name string = strings.SplitN(setting, ".", 2)[0];
+    var limits *ClientLimitSettings = &data.clientLimits;
+    var clusterPortLimits ClientLimitSettings;
+    var err error;
+
+    if(name != "clientRateLimit" && name != "clientRateBurst" && name != "clientMaxConnections") {
+        return false;
+    }
+
+    // Select cluster port overrides, leaving every other limit unset
+    var clusterPort int = clusterPortSettingSuffix(setting);
+    if(clusterPort != 0) {
+        var found bool;
+        clusterPortLimits, found = data.clusterPortClientLimits[clusterPort];
+        if(!found) {
+            clusterPortLimits = ClientLimitSettings{-1, -1, -1};
+        }
+        limits = &clusterPortLimits;
+    }
+
+    switch name {
+        case "clientRateLimit":
+            limits.rate, err = strconv.ParseFloat(value, 64);
+            if(err == nil && limits.rate < 0) {
+                err = fmt.Errorf("negative rate");
+            }
+        case "clientRateBurst":
+            limits.burst, err = strconv.Atoi(value);
+            if(err == nil && limits.burst < 0) {
+                err = fmt.Errorf("negative burst");
+            }
+        case "clientMaxConnections":
+            limits.maxConnections, err = strconv.Atoi(value);
+            if(err == nil && limits.maxConnections < 0) {
+                err = fmt.Errorf("negative number of connections");
+            }
+    }
+    if(err != nil) {
+        log.Printf("Error converting %s: %s. Message: %v", setting, value, err);
+        os.Exit(1);
+    }
+    if(clusterPort != 0) {
+        data.clusterPortClientLimits[clusterPort] = clusterPortLimits;
+    }
+    return true;
+}
+
+/*============================
+ clientLimitsForClusterPort
+
+ This procedure returns the client limits in effect for a cluster port: the global
+ limits, overridden by any limit set for that cluster port.
+
+ Parameters:
+    programSettings: loaded program settings
+    clusterPort: cluster port
+
+ Returns:
+    Client limits in effect
+============================*/
+func clientLimitsForClusterPort(programSettings ProgramSettings, clusterPort int) (ClientLimitSettings) {
+    var limits ClientLimitSettings = programSettings.clientLimits;
+    var overrides, found = programSettings.clusterPortClientLimits[clusterPort];
+    if(found) {
+        if(overrides.rate >= 0) {
+            limits.rate = overrides.rate;
+        }
+        if(overrides.burst >= 0) {
+            limits.burst = overrides.burst;
+        }
+        if(overrides.maxConnections >= 0) {
+            limits.maxConnections = overrides.maxConnections;
+        }
+    }
+    // Without burst, allow at least one connection at once
+    if(limits.burst == 0) {
+        limits.burst = int(math.Ceil(limits.rate));
+    }
+    return limits;
+}
+
+/*============================
+ acquire
+
+ This procedure admits a new connection of a client on a cluster port. Each client
+ IP has, per cluster port, a token bucket refilled at the configured rate up to the
+ burst size, and a count of active connections.
+
+ Parameters:
+    clusterPort: cluster port
+    clientIp: effective client IP
+    limits: client limits of the cluster port
+
+ Returns:
+    Empty string when the connection is admitted, the rejection reason otherwise:
+    "rate_limit" or "concurrency_limit"
+============================*/
+func (limiter *ClientLimiter) acquire(clusterPort int, clientIp string, limits ClientLimitSettings) (string) {
+    if(limits.rate == 0 && limits.maxConnections == 0) {
+        return "";
+    }
+    limiter.lock.Lock();
+    defer limiter.lock.Unlock();
+    var now time.Time = time.Now();
+
+    // Forget idle clients from time to time
+    var key string;
+    var bucket *ClientBucket;
+    if(now.Sub(limiter.lastSweep) > time.Minute) {
+        for key, bucket = range limiter.clients {
+            if(bucket.activeConnections == 0 && now.Sub(bucket.updated) > time.Minute) {
+                delete(limiter.clients, key);
+            }
+        }
+        limiter.lastSweep = now;
+    }
+
+    key = net.JoinHostPort(clientIp, strconv.Itoa(clusterPort));
+    bucket = limiter.clients[key];
+    if(bucket == nil) {
+        bucket = &ClientBucket{tokens: float64(limits.burst), updated: now};
+        limiter.clients[key] = bucket;
+    }
+    if(limits.maxConnections > 0 && bucket.activeConnections >= limits.maxConnections) {
+        return "concurrency_limit";
+    }
+    if(limits.rate > 0) {
+        bucket.tokens = math.Min(float64(limits.burst), bucket.tokens + now.Sub(bucket.updated).Seconds() * limits.rate);
+        bucket.updated = now;
+        if(bucket.tokens < 1) {
+            return "rate_limit";
+        }
+        bucket.tokens--;
+    }
+    bucket.updated = now;
+    bucket.activeConnections++;
+    return "";
+}
+
+func (limiter *ClientLimiter) release(clusterPort int, clientIp string) {
+    limiter.lock.Lock();
+    defer limiter.lock.Unlock();
+    var bucket *ClientBucket = limiter.clients[net.JoinHostPort(clientIp, strconv.Itoa(clusterPort))];
+    if(bucket != nil) {
+        bucket.activeConnections--;
+    }
+}
+
+/*============================
+ acquire
+
+ This procedure reserves a connection slot on a host port, unless the host port
+ already reached its maximum number of active connections.
+
+ Parameters:
+    hostPort: host port
+    maxConnections: maximum number of active connections
+
+ Returns:
+    True when a slot was reserved, false otherwise
+============================*/
+func (balancer *HostPortsBalancer) acquire(hostPort int, maxConnections int) (bool) {
+    balancer.lock.Lock();
+    defer balancer.lock.Unlock();
+    if(balancer.activeConnectionsCount[hostPort] >= maxConnections) {
+        return false;
+    }
+    balancer.activeConnectionsCount[hostPort]++;
+    return true;
+}
+
+func (balancer *HostPortsBalancer) release(hostPort int) {
+    balancer.lock.Lock();
+    defer balancer.lock.Unlock();
+    balancer.activeConnectionsCount[hostPort]--;
+}
+
+/*============================
+ recordRouted
+
+ This procedure counts a connection routed to a host port and returns the resulting
+ traffic split of the cluster port: for each primary host port, the expected share
+ of connections given its weight and the share it actually received so far.
+
+ Parameters:
+    clusterPort: cluster port
+    hostPort: host port the connection was routed to
+    ports: cluster port entries
+
+ Returns:
+    Expected and achieved shares, keyed by host port
+============================*/
+func (balancer *HostPortsBalancer) recordRouted(clusterPort int, hostPort int, ports []PortsConfigurationData) (map[int]float64, map[int]float64) {
+    balancer.lock.Lock();
+    defer balancer.lock.Unlock();
+    if(balancer.routedConnections[clusterPort] == nil) {
+        balancer.routedConnections[clusterPort] = make(map[int]int64);
+    }
+    balancer.routedConnections[clusterPort][hostPort]++;
+
+    var expected map[int]float64 = make(map[int]float64);
+    var achieved map[int]float64 = make(map[int]float64);
+    var totalWeight int = 0;
+    var totalRouted int64 = 0;
+    var portsData PortsConfigurationData;
+    for _, portsData = range ports {
+        if(!portsData.backup && !portsData.mirror) {
+            totalWeight += hostPortWeight(portsData);
+        }
+        totalRouted += balancer.routedConnections[clusterPort][portsData.hostPort];
+    }
+    for _, portsData = range ports {
+        if(!portsData.backup && !portsData.mirror && totalWeight > 0) {
+            expected[portsData.hostPort] = float64(hostPortWeight(portsData)) / float64(totalWeight);
+        }
+        if(totalRouted > 0) {
+            achieved[portsData.hostPort] = float64(balancer.routedConnections[clusterPort][portsData.hostPort]) / float64(totalRouted);
+        }
+    }
+    return expected, achieved;
+}
+
+/*============================
+ track
+
+ This procedure records when each host port of a ports configuration was first seen,
+ so that host ports added later on are slow-started. Host ports no longer configured
+ are forgotten: should they come back, they are slow-started again.
+
+ Parameters:
+    portsConfiguration: current ports configuration
+    warm: true when the host ports are not to be slow-started, e.g. on startup
+============================*/
+func (balancer *HostPortsBalancer) track(portsConfiguration PortsConfigurationMap, warm bool) {
+    balancer.lock.Lock();
+    defer balancer.lock.Unlock();
+    var configured map[int]bool = make(map[int]bool);
+    var portsDataList []PortsConfigurationData;
+    var portsData PortsConfigurationData;
+    for _, portsDataList = range portsConfiguration {
+        for _, portsData = range portsDataList {
+            configured[portsData.hostPort] = true;
+            var _, found = balancer.firstSeen[portsData.hostPort];
+            if(!found) {
+                if(warm) {
+                    balancer.firstSeen[portsData.hostPort] = time.Time{};
+                } else {
+                    log.Printf("Slow-starting new host port %d", portsData.hostPort);
+                    balancer.firstSeen[portsData.hostPort] = time.Now();
+                }
+            }
+        }
+    }
+    var hostPort int;
+    for hostPort = range balancer.firstSeen {
+        if(!configured[hostPort]) {
+            delete(balancer.firstSeen, hostPort);
+        }
+    }
+}
+
+/*============================
+ slowStart
+
+ This procedure returns a cluster port entry with its maxConnections and weight
+ ramped up linearly, from 1 to their configured values, over the slow-start window
+ following the first time the host port was seen.
+
+ Parameters:
+    portsData: cluster port entry
+
+ Returns:
+    Cluster port entry with its effective maxConnections and weight
+============================*/
+func (balancer *HostPortsBalancer) slowStart(portsData PortsConfigurationData) (PortsConfigurationData) {
+    var window time.Duration = balancer.slowStartWindow;
+    if(portsData.slowStart > 0) {
+        window = portsData.slowStart;
+    }
+    if(window <= 0) {
+        return portsData;
+    }
+    balancer.lock.Lock();
+    var firstSeen time.Time = balancer.firstSeen[portsData.hostPort];
+    balancer.lock.Unlock();
+    var elapsed time.Duration = time.Since(firstSeen);
+    if(firstSeen.IsZero() || elapsed >= window) {
+        return portsData;
+    }
+
+    var ramp = func(value int) (int) {
+        var ramped int = int(float64(value) * float64(elapsed) / float64(window));
+        if(ramped < 1) {
+            return 1;
+        }
+        return ramped;
+    };
+    portsData.weight = ramp(hostPortWeight(portsData));
+    if(portsData.maxConnections > 0) {
+        portsData.maxConnections = ramp(portsData.maxConnections);
+    }
+    return portsData;
+}
+
+func (balancer *HostPortsBalancer) activeConnections(hostPort int) (int) {
+    balancer.lock.Lock();
+    defer balancer.lock.Unlock();
+    return balancer.activeConnectionsCount[hostPort];
+}
+
+/*============================
+ order
+
+ This procedure returns the order in which host ports of a cluster port should be
+ tried for a new connection. Primary host ports come first, ordered by the load
+ balancing strategy. Backup host ports follow, ordered the same way, so that they are
+ only reached when every primary host port is full or refusing connections.
+ Mirror host ports are left out. Slow-started host ports get their effective
+ maxConnections and weight.
+
+ Parameters:
+    clusterPort: cluster port
+    strategy: load balancing strategy
+    ports: cluster port entries
+
+ Returns:
+    Ordered list of cluster port entries
+============================*/
+func (balancer *HostPortsBalancer) order(clusterPort int, strategy string, ports []PortsConfigurationData) ([]PortsConfigurationData) {
+    var primaries []PortsConfigurationData;
+    var backups []PortsConfigurationData;
+    var portsData PortsConfigurationData;
+    for _, portsData = range ports {
+        portsData = balancer.slowStart(portsData);
+        if(portsData.mirror) {
+            continue;
+        } else if(portsData.backup) {
+            backups = append(backups, portsData);
+        } else {
+            primaries = append(primaries, portsData);
+        }
+    }
+
+    // Backups keep their own round robin position, under the negated cluster port
+    return append(balancer.orderEntries(clusterPort, strategy, primaries), balancer.orderEntries(-clusterPort, strategy, backups)...);
+}
+
+/*============================
+ orderEntries
+
+ This procedure orders a list of cluster port entries by load balancing strategy.
+
+ Strategies:
+    sequential: configuration file order
+    roundrobin: configuration file order, starting one entry further at each connection
+    leastconn: fewest active connections first, ties in configuration file order
+    random: uniformly shuffled
+    weighted: drawn at random proportionally to the host port weight
+
+ Parameters:
+    roundRobinKey: key of the round robin position
+    strategy: load balancing strategy
+    ports: cluster port entries
+
+ Returns:
+    Ordered list of cluster port entries
+============================*/
+func (balancer *HostPortsBalancer) orderEntries(roundRobinKey int, strategy string, ports []PortsConfigurationData) ([]PortsConfigurationData) {
+    var ordered []PortsConfigurationData = make([]PortsConfigurationData, len(ports));
+    copy(ordered, ports);
+    if(len(ordered) < 2) {
+        return ordered;
+    }
+
+    switch strategy {
+        case "roundrobin":
+            balancer.lock.Lock();
+            var start int = balancer.roundRobinIndex[roundRobinKey] % len(ordered);
+            balancer.roundRobinIndex[roundRobinKey] = start + 1;
+            balancer.lock.Unlock();
+            ordered = append(ordered[start:], ordered[:start]...);
+        case "leastconn":
+            balancer.lock.Lock();
+            sort.SliceStable(ordered, func(i int, j int) (bool) {
+                return balancer.activeConnectionsCount[ordered[i].hostPort] < balancer.activeConnectionsCount[ordered[j].hostPort];
+            });
+            balancer.lock.Unlock();
+        case "random":
+            rand.Shuffle(len(ordered), func(i int, j int) {
+                ordered[i], ordered[j] = ordered[j], ordered[i];
+            });
+        case "weighted":
+            var shuffled []PortsConfigurationData = make([]PortsConfigurationData, 0, len(ordered));
+            var totalWeight int = 0;
+            var portsData PortsConfigurationData;
+            for _, portsData = range ordered {
+                totalWeight += hostPortWeight(portsData);
+            }
+            for len(ordered) > 0 && totalWeight > 0 {
+                var pick int = rand.Intn(totalWeight);
+                var index int;
+                for index = 0; index < len(ordered); index++ {
+                    pick -= hostPortWeight(ordered[index]);
+                    if(pick < 0) {
+                        break;
+                    }
+                }
+                totalWeight -= hostPortWeight(ordered[index]);
+                shuffled = append(shuffled, ordered[index]);
+                ordered = append(ordered[:index], ordered[index+1:]...);
+            }
+            ordered = append(shuffled, ordered...);
+    }
+    return ordered;
+}
+
+/*============================
+ Write
+
+ This procedure queues a copy of client data for the mirror host port. It never
+ blocks nor fails, so that the primary connection is not affected by the mirror.
+ Once the buffered data would exceed its limit, mirroring of the connection stops
+ for good, since the mirrored stream would be incomplete anyway. Every chunk of
+ client data not mirrored is reported to onDrop.
+
+ Parameters:
+    data: client data
+
+ Returns:
+    Length of data, and no error
+============================*/
+func (writer *MirrorWriter) Write(data []byte) (int, error) {
+    if(atomic.LoadInt32(&writer.dropped) == 1) {
+        writer.onDrop();
+        return len(data), nil;
+    }
+    if(atomic.AddInt64(&writer.bufferedBytes, int64(len(data))) > writer.maxBufferedBytes) {
+        atomic.AddInt64(&writer.bufferedBytes, -int64(len(data)));
+        atomic.StoreInt32(&writer.dropped, 1);
+        writer.onDrop();
+        return len(data), nil;
+    }
+    var chunk []byte = make([]byte, len(data));
+    copy(chunk, data);
+    select {
+        case writer.chunks <- chunk:
+        default:
+            atomic.AddInt64(&writer.bufferedBytes, -int64(len(data)));
+            atomic.StoreInt32(&writer.dropped, 1);
+            writer.onDrop();
+    }
+    return len(data), nil;
+}
+
+func (checker *HealthChecker) isHealthy(hostPort int) (bool) {
+    checker.lock.Lock();
+    defer checker.lock.Unlock();
+    return !checker.unhealthy[hostPort];
+}
+
+/*============================
+ checkHostPort
+
+ This procedure runs a single health check against a host port.
+
+ Parameters:
+    mode: network mode
+    address: host port address
+    portsData: ports configuration entry, holding the health check options
+
+ Returns:
+    Error when the host port is unhealthy, nil otherwise
+============================*/
+func checkHostPort(mode string, address string, portsData PortsConfigurationData) (error) {
+    var timeout time.Duration = portsData.checkTimeout;
+    if(timeout <= 0) {
+        timeout = 1 * time.Second;
+    }
+    var host string = net.JoinHostPort(address, strconv.Itoa(portsData.hostPort));
+
+    if(portsData.check == "http") {
+        var path string = portsData.checkPath;
+        if(!strings.HasPrefix(path, "/")) {
+            path = "/" + path;
+        }
+        var client *http.Client = &http.Client{Timeout: timeout};
+        response, err := client.Get("http://" + host + path);
+        if(err != nil) {
+            return err;
+        }
+        io.Copy(ioutil.Discard, response.Body);
+        response.Body.Close();
+        if(response.StatusCode < 200 || response.StatusCode >= 400) {
+            return fmt.Errorf("unexpected status %s", response.Status);
+        }
+        return nil;
+    }
+
+    connection, err := net.DialTimeout(mode, host, timeout);
+    if(err != nil) {
+        return err;
+    }
+    connection.Close();
+    return nil;
+}
+
+/*============================
+ run
+
+ This procedure checks, in the background and for as long as the program runs, every
+ host port of the current ports configuration which has a health check option. Host
+ ports which fail their check are reported unhealthy until a later check succeeds.
+
+ Parameters:
+    mode: network mode
+    address: host ports address
+    portsConfiguration: getter for the current ports configuration
+============================*/
+func (checker *HealthChecker) run(mode string, address string, portsConfiguration func() (PortsConfigurationMap)) {
+    for {
+        var checked map[int]bool = make(map[int]bool);
+        var portsDataList []PortsConfigurationData;
+        var portsData PortsConfigurationData;
+        for _, portsDataList = range portsConfiguration() {
+            for _, portsData = range portsDataList {
+                if(portsData.check == "" || checked[portsData.hostPort]) {
+                    continue;
+                }
+                checked[portsData.hostPort] = true;
+
+                var interval time.Duration = portsData.checkInterval;
+                if(interval <= 0) {
+                    interval = 5 * time.Second;
+                }
+                checker.lock.Lock();
+                var due bool = !checker.checking[portsData.hostPort] && time.Since(checker.lastCheck[portsData.hostPort]) >= interval;
+                if(due) {
+                    checker.checking[portsData.hostPort] = true;
+                    checker.lastCheck[portsData.hostPort] = time.Now();
+                }
+                checker.lock.Unlock();
+                if(!due) {
+                    continue;
+                }
+
+                go func(portsData PortsConfigurationData) {
+                    var err error = checkHostPort(mode, address, portsData);
+                    checker.lock.Lock();
+                    defer checker.lock.Unlock();
+                    checker.checking[portsData.hostPort] = false;
+                    if(err != nil && !checker.unhealthy[portsData.hostPort]) {
+                        log.Printf("Health check failed for host port %d (pod %s): %v. Marking as unhealthy", portsData.hostPort, portsData.podId, err);
+                        checker.unhealthy[portsData.hostPort] = true;
+                    } else if(err == nil && checker.unhealthy[portsData.hostPort]) {
+                        log.Printf("Health check succeeded for host port %d (pod %s). Marking as healthy", portsData.hostPort, portsData.podId);
+                        delete(checker.unhealthy, portsData.hostPort);
+                    }
+                } (portsData);
+            }
+        }
+
+        // Forget host ports which are no longer checked
+        checker.lock.Lock();
+        var hostPort int;
+        for hostPort = range checker.lastCheck {
+            if(!checked[hostPort] && !checker.checking[hostPort]) {
+                delete(checker.lastCheck, hostPort);
+                delete(checker.unhealthy, hostPort);
+                delete(checker.checking, hostPort);
+            }
+        }
+        checker.lock.Unlock();
+
+        time.Sleep(1 * time.Second);
+    }
+}
+
+/*============================
+ recordFailure
+
+ This procedure counts a failed connection to an endpoint, either a dial error or
+ a connection closed before any byte was returned. Once the consecutive failures
+ reach the configured threshold, the endpoint is ejected. The ejection time doubles
+ with every consecutive ejection, up to the configured maximum.
+
+ Parameters:
+    endpoint: host endpoint or host port
+
+ Returns:
+    True when the endpoint got ejected
+============================*/
+func (detector *OutlierDetector) recordFailure(endpoint string) (bool) {
+    if(detector.consecutiveFailures <= 0) {
+        return false;
+    }
+    detector.lock.Lock();
+    defer detector.lock.Unlock();
+    detector.failures[endpoint]++;
+    if(detector.failures[endpoint] < detector.consecutiveFailures) {
+        return false;
+    }
+    detector.failures[endpoint] = 0;
+
+    var ejectionTime time.Duration = detector.baseEjectionTime;
+    var ejection int;
+    for ejection = 0; ejection < detector.ejections[endpoint] && ejectionTime < detector.maxEjectionTime; ejection++ {
+        ejectionTime *= 2;
+    }
+    if(ejectionTime > detector.maxEjectionTime) {
+        ejectionTime = detector.maxEjectionTime;
+    }
+    detector.ejections[endpoint]++;
+    detector.ejectedUntil[endpoint] = time.Now().Add(ejectionTime);
+    log.Printf("Ejecting %s for %v after %d consecutive failures", endpoint, ejectionTime, detector.consecutiveFailures);
+    return true;
+}
+
+func (detector *OutlierDetector) recordSuccess(endpoint string) {
+    detector.lock.Lock();
+    defer detector.lock.Unlock();
+    delete(detector.failures, endpoint);
+    if(!detector.ejectedUntil[endpoint].After(time.Now())) {
+        delete(detector.ejections, endpoint);
+        delete(detector.ejectedUntil, endpoint);
+    }
+}
+
+func (detector *OutlierDetector) isEjected(endpoint string) (bool) {
+    detector.lock.Lock();
+    defer detector.lock.Unlock();
+    return detector.ejectedUntil[endpoint].After(time.Now());
+}
+
+/*============================
+ orderHosts
+
+ This procedure moves ejected hosts to the end of the given hosts list, keeping
+ them only as a last resort. The relative order of the hosts is preserved.
+
+ Parameters:
+    hosts: ordered hosts list
+
+ Returns:
+    Hosts list, ejected hosts last
+============================*/
+func (detector *OutlierDetector) orderHosts(hosts []HostsConfigurationData) ([]HostsConfigurationData) {
+    var available []HostsConfigurationData;
+    var ejected []HostsConfigurationData;
+    var hostData HostsConfigurationData;
+    for _, hostData = range hosts {
+        if(detector.isEjected(net.JoinHostPort(hostData.address, strconv.Itoa(hostData.port)))) {
+            ejected = append(ejected, hostData);
+        } else {
+            available = append(available, hostData);
+        }
+    }
+    return append(available, ejected...);
+}
+
+/*============================
+ orderHostPorts
+
+ This procedure moves ejected host ports to the end of the given ports list, keeping
+ them only as a last resort. The relative order of the host ports is preserved.
+
+ Parameters:
+    ports: ordered ports configuration entries
+
+ Returns:
+    Ports configuration entries, ejected host ports last
+============================*/
+func (detector *OutlierDetector) orderHostPorts(ports []PortsConfigurationData) ([]PortsConfigurationData) {
+    var available []PortsConfigurationData;
+    var ejected []PortsConfigurationData;
+    var portsData PortsConfigurationData;
+    for _, portsData = range ports {
+        if(detector.isEjected(strconv.Itoa(portsData.hostPort))) {
+            ejected = append(ejected, portsData);
+        } else {
+            available = append(available, portsData);
+        }
+    }
+    return append(available, ejected...);
+}
+
+/*============================
+ load
+
+ This procedure loads the certificate, its key and the CA bundle used by the
+ proxies to authenticate each other, whenever the modification time of one of the
+ files has changed since the last attempt. On errors, the previously loaded files
+ are kept, and the invalid files are only read again once they change.
+
+ Returns:
+    Error while loading the files, nil otherwise
+============================*/
+func (store *CertificateStore) load() (error) {
+    var changed bool = false;
+    var modTimes map[string]time.Time = make(map[string]time.Time);
+    var filePath string;
+    for _, filePath = range []string{store.certificateFile, store.keyFile, store.caFile} {
+        fileStat, err := os.Stat(filePath);
+        if(err != nil) {
+            return err;
+        }
+        modTimes[filePath] = fileStat.ModTime();
+        if(!fileStat.ModTime().Equal(store.modTimes[filePath])) {
+            changed = true;
+        }
+    }
+    if(!changed) {
+        return nil;
+    }
+
+    // Modification times are taken before reading, so that files changed meanwhile are read again
+    store.modTimes = modTimes;
+    certificate, err := tls.LoadX509KeyPair(store.certificateFile, store.keyFile);
+    if(err != nil) {
+        return err;
+    }
+    caData, err := ioutil.ReadFile(store.caFile);
+    if(err != nil) {
+        return err;
+    }
+    var caPool *x509.CertPool = x509.NewCertPool();
+    if(!caPool.AppendCertsFromPEM(caData)) {
+        return fmt.Errorf("no certificate found in %s", store.caFile);
+    }
+
+    store.lock.Lock();
+    defer store.lock.Unlock();
+    store.certificate = &certificate;
+    store.caPool = caPool;
+    log.Printf("Loaded TLS certificate %s and CA bundle %s", store.certificateFile, store.caFile);
+    return nil;
+}
+
+func (store *CertificateStore) serverConfig() (*tls.Config) {
+    store.lock.RLock();
+    defer store.lock.RUnlock();
+    return &tls.Config{
+        Certificates: []tls.Certificate{*store.certificate},
+        ClientCAs: store.caPool,
+        ClientAuth: tls.RequireAndVerifyClientCert,
+        MinVersion: tls.VersionTLS12,
+    };
+}
+
+func (store *CertificateStore) clientConfig(serverName string) (*tls.Config) {
+    store.lock.RLock();
+    defer store.lock.RUnlock();
+    return &tls.Config{
+        Certificates: []tls.Certificate{*store.certificate},
+        RootCAs: store.caPool,
+        ServerName: serverName,
+        MinVersion: tls.VersionTLS12,
+    };
+}
+
+/*============================
+ tlsHandshakeTimeout
+
+ This procedure returns the time given to a TLS handshake between proxies. Unlike
+ other timeouts, it is never disabled, so that a silent peer cannot hold a connection.
+
+ Parameters:
+    timeouts: timeout settings
+
+ Returns:
+    handshakeTimeout, or 5 seconds when it is disabled
+============================*/
+func tlsHandshakeTimeout(timeouts TimeoutSettings) (time.Duration) {
+    if(timeouts.handshakeTimeout > 0) {
+        return timeouts.handshakeTimeout;
+    }
+    return 5 * time.Second;
+}
+
+/*============================
+ parseCidrs
+
+ This procedure parses a comma separated list of CIDRs. Single addresses are
+ accepted as well, as a CIDR of their own.
+
+ Parameters:
+    value: list of CIDRs, e.g. 10.0.0.0/8,192.168.1.10
+
+ Returns:
+    Parsed CIDRs, and error on invalid entries
+============================*/
+func parseCidrs(value string) ([]*net.IPNet, error) {
+    var cidrs []*net.IPNet;
+    var entry string;
+    for _, entry = range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry);
+        if(entry == "") {
+            continue;
+        }
+        if(!strings.Contains(entry, "/")) {
+            var ip net.IP = net.ParseIP(entry);
+            if(ip == nil) {
+                return nil, fmt.Errorf("invalid address %s", entry);
+            }
+            if(ip.To4() != nil) {
+                entry = entry + "/32";
+            } else {
+                entry = entry + "/128";
+            }
+        }
+        _, cidr, err := net.ParseCIDR(entry);
+        if(err != nil) {
+            return nil, err;
+        }
+        cidrs = append(cidrs, cidr);
+    }
+    return cidrs, nil;
+}
+
+/*============================
+ isAllowedSource
+
+ This procedure checks whether a connection to the local ports proxy comes from
+ another proxy: its source address must be the one of a host of hosts.txt, or
+ belong to one of the extra allowed CIDRs.
+
+ Parameters:
+    address: connection remote address
+    hosts: hosts list, with resolved addresses
+    cidrs: extra allowed CIDRs
+
+ Returns:
+    True when the source is allowed
+============================*/
+func isAllowedSource(address net.Addr, hosts []HostsConfigurationData, cidrs []*net.IPNet) (bool) {
+    remoteIp, _, err := net.SplitHostPort(address.String());
+    if(err != nil) {
+        return false;
+    }
+    var ip net.IP = net.ParseIP(remoteIp);
+    if(ip == nil) {
+        return false;
+    }
+    var hostData HostsConfigurationData;
+    for _, hostData = range hosts {
+        if(net.ParseIP(hostData.address).Equal(ip)) {
+            return true;
+        }
+    }
+    var cidr *net.IPNet;
+    for _, cidr = range cidrs {
+        if(cidr.Contains(ip)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+/*============================
+ verifyPeerIdentity
+
+ This procedure checks that the certificate presented by a remote proxy belongs to
+ a host of hosts.txt with the same address as the connection: the certificate
+ must be valid for the host name or address given in hosts.txt.
+
+ Parameters:
+    connection: TLS connection, past its handshake
+    hosts: hosts list, with resolved addresses
+
+ Returns:
+    Error when the remote proxy is not listed in hosts.txt, nil otherwise
+============================*/
+func verifyPeerIdentity(connection *tls.Conn, hosts []HostsConfigurationData) (error) {
+    var peerCertificates []*x509.Certificate = connection.ConnectionState().PeerCertificates;
+    if(len(peerCertificates) == 0) {
+        return fmt.Errorf("no peer certificate");
+    }
+    remoteIp, _, err := net.SplitHostPort(connection.RemoteAddr().String());
+    if(err != nil) {
+        return err;
+    }
+    var hostData HostsConfigurationData;
+    for _, hostData = range hosts {
+        if(net.ParseIP(hostData.address).Equal(net.ParseIP(remoteIp)) && peerCertificates[0].VerifyHostname(hostData.host) == nil) {
+            return nil;
+        }
+    }
+    return fmt.Errorf("certificate %q of %s does not match any host of the hosts configuration", peerCertificates[0].Subject.CommonName, remoteIp);
+}
+
+/*============================
+ signature
+
+ This procedure computes the signature of an inter-proxy handshake: an HMAC-SHA256,
+ keyed with the cluster secret, over the target host, the handshake header, a timestamp
+ and a nonce. Nonces are only remembered by the target host, so the target host is signed
+ too: a handshake sent to one host cannot be replayed to another one.
+
+ Parameters:
+    target: address and port of the target host, as dialed from hosts.txt
+    message: signed header fields, see handshakeMessage
+    timestamp: signature time, in seconds since epoch
+    nonce: random value, unique to the handshake
+
+ Returns:
+    Hex encoded signature
+============================*/
+func (authenticator *HandshakeAuthenticator) signature(target string, message string, timestamp int64, nonce string) (string) {
+    var mac = hmac.New(sha256.New, authenticator.secret);
+    fmt.Fprintf(mac, "%s %s %d %s", target, message, timestamp, nonce);
+    return hex.EncodeToString(mac.Sum(nil));
+}
+
+/*============================
+ handshakeMessage
+
+ This procedure returns the signed part of a legacy handshake, made of the proxy
+ protocol header fields. Internal headers are signed as a whole instead.
+
+ Parameters:
+    clientIp, proxyIp, clientPort, proxyPort: proxy protocol header fields
+
+ Returns:
+    Signed message
+============================*/
+func handshakeMessage(clientIp string, proxyIp string, clientPort int, proxyPort int) (string) {
+    return fmt.Sprintf("%s %s %d %d", clientIp, proxyIp, clientPort, proxyPort);
+}
+
+/*============================
+ sign
+
+ This procedure returns the authentication line sent right after the handshake
+ header to the local ports proxy of another host.
+ Format: "AUTH <timestamp> <nonce> <signature>\r\n"
+
+ Parameters:
+    target: address and port of the target host
+    message: signed header fields
+
+ Returns:
+    Authentication line
+============================*/
+func (authenticator *HandshakeAuthenticator) sign(target string, message string) (string) {
+    var nonceBytes []byte = make([]byte, 16);
+    cryptorand.Read(nonceBytes);
+    var nonce string = hex.EncodeToString(nonceBytes);
+    var timestamp int64 = time.Now().Unix();
+    return fmt.Sprintf("AUTH %d %s %s\r\n", timestamp, nonce, authenticator.signature(target, message, timestamp, nonce));
+}
+
+/*============================
+ verify
+
+ This procedure reads the authentication line following a handshake header and
+ checks it: the signature must match this host and the header fields, the timestamp
+ must be within the maximum clock skew, and the nonce must not have been seen before.
+ The line is bounded by maxAuthLineLength.
+
+ Parameters:
+    reader: connection reader, past the handshake header
+    target: local address and port the handshake was received on
+    message: signed header fields
+
+ Returns:
+    Error when the handshake is unsigned, forged or replayed, nil otherwise
+============================*/
+func (authenticator *HandshakeAuthenticator) verify(reader *bufio.Reader, target string, message string) (error) {
+    line, err := readHeaderLine(reader, maxAuthLineLength);
+    if(err != nil) {
+        return fmt.Errorf("error reading authentication line: %v", err);
+    }
+    var fields []string = strings.Fields(line);
+    if(len(fields) != 4 || fields[0] != "AUTH") {
+        return fmt.Errorf("unsigned handshake");
+    }
+    timestamp, err := strconv.ParseInt(fields[1], 10, 64);
+    if(err != nil) {
+        return fmt.Errorf("invalid timestamp %s", fields[1]);
+    }
+    var nonce string = fields[2];
+    var expected string = authenticator.signature(target, message, timestamp, nonce);
+    if(!hmac.Equal([]byte(expected), []byte(fields[3]))) {
+        return fmt.Errorf("invalid signature");
+    }
+    var skew time.Duration = time.Since(time.Unix(timestamp, 0));
+    if(skew > authenticator.maxClockSkew || skew < -authenticator.maxClockSkew) {
+        return fmt.Errorf("timestamp off by %v", skew);
+    }
+
+    // Nonces only need to be remembered for as long as their timestamp is accepted.
+    // Expired ones are forgotten from time to time, rather than on every handshake.
+    authenticator.lock.Lock();
+    defer authenticator.lock.Unlock();
+    var now time.Time = time.Now();
+    var seenNonce string;
+    var expiry time.Time;
+    if(now.Sub(authenticator.lastSweep) > authenticator.maxClockSkew) {
+        for seenNonce, expiry = range authenticator.nonces {
+            if(now.After(expiry)) {
+                delete(authenticator.nonces, seenNonce);
+            }
+        }
+        authenticator.lastSweep = now;
+    }
+    var _, found = authenticator.nonces[nonce];
+    if(found) {
+        return fmt.Errorf("replayed nonce %s", nonce);
+    }
+    authenticator.nonces[nonce] = time.Unix(timestamp, 0).Add(authenticator.maxClockSkew);
+    return nil;
+}
+
+/*============================
+ startMirror
+
+ This procedure connects to a mirror host port in the background and relays to it
+ all data queued on the returned writer. Replies from the mirror are discarded.
+ Every write is bounded by mirrorWriteTimeout: a mirror not keeping up stops being
+ mirrored to, instead of holding queued data and its connection forever.
+ The writer must be closed with stopMirror once the client is done sending.
+
+ Parameters:
+    mode: network mode
+    host: mirror host address
+    portsData: mirror ports configuration entry
+    dialTimeout: connect timeout
+    maxBufferedBytes: maximum amount of data queued for the mirror
+    clientIp, proxyIp, clientPort, proxyPort: proxy protocol header fields
+    onDrop: called for every chunk of mirrored data dropped
+
+ Returns:
+    Mirror writer
+============================*/
+func startMirror(mode string, host string, portsData PortsConfigurationData, dialTimeout time.Duration, maxBufferedBytes int, clientIp string, proxyIp string, clientPort int, proxyPort int, onDrop func()) (*MirrorWriter) {
+    var writer *MirrorWriter = &MirrorWriter{
+        chunks: make(chan []byte, 256),
+        maxBufferedBytes: int64(maxBufferedBytes),
+        onDrop: onDrop,
+    };
+
+    go func() {
+        var mirrorConnection net.Conn;
+        var err error;
+        var chunk []byte;
+        defer writer.close();
+
+        mirrorConnection, err = net.DialTimeout(mode, host, dialTimeout);
+        if(err != nil) {
+            log.Printf("Error connecting to mirror %s: %v", host, err);
+        } else {
+            writer.lock.Lock();
+            writer.connection = mirrorConnection;
+            if(writer.closed) {
+                mirrorConnection.Close();
+            }
+            writer.lock.Unlock();
+            go io.Copy(ioutil.Discard, mirrorConnection);
+            if(portsData.sendProxyFlag) {
+                mirrorConnection.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout));
+                err = writeProxyHeader(mirrorConnection, portsData.proxyVersion, clientIp, proxyIp, clientPort, proxyPort);
+            }
+        }
+        if(err != nil) {
+            atomic.StoreInt32(&writer.dropped, 1);
+        }
+
+        for chunk = range writer.chunks {
+            atomic.AddInt64(&writer.bufferedBytes, -int64(len(chunk)));
+            if(atomic.LoadInt32(&writer.dropped) == 1) {
+                onDrop();
+                continue;
+            }
+            mirrorConnection.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout));
+            _, err = mirrorConnection.Write(chunk);
+            if(err != nil) {
+                log.Printf("Error copying data to mirror %s: %v", host, err);
+                atomic.StoreInt32(&writer.dropped, 1);
+                writer.close();
+                onDrop();
+            }
+        }
+    } ();
+
+    return writer;
+}
+
+/*============================
+ stopMirror
+
+ This procedure ends mirroring once the client is done sending. Data still queued
+ is given mirrorWriteTimeout to be written, then the mirror connection is closed
+ whether the mirror took it or not.
+
+ Parameters:
+    writer: mirror writer returned by startMirror
+============================*/
+func stopMirror(writer *MirrorWriter) {
+    close(writer.chunks);
+    time.AfterFunc(mirrorWriteTimeout, writer.close);
+}
+
+func (writer *MirrorWriter) close() {
+    writer.lock.Lock();
+    defer writer.lock.Unlock();
+    writer.closed = true;
+    if(writer.connection != nil) {
+        writer.connection.Close();
+    }
+}
+
+func (reader ActivityReader) Read(dst []byte) (int, error) {
+    n, err := reader.Reader.Read(dst);
+    if(n > 0) {
+        atomic.StoreInt64(reader.lastActivity, time.Now().UnixNano());
+        if(reader.bytesRead != nil) {
+            atomic.AddInt64(reader.bytesRead, int64(n));
+        }
+    }
+    return n, err;
+}
+
+/*============================
+ Read
+
+ This procedure reads client data, keeping a copy of it so that it can be replayed
+ to another host. Once the copy would exceed its limit, or the host has returned
+ any byte, it is dropped for good, since the client data can no longer be replayed
+ anyway.
+
+ Parameters:
+    dst: destination buffer
+
+ Returns:
+    Amount of data read, and read error if any
+============================*/
+func (replay *ReplayBuffer) Read(dst []byte) (int, error) {
+    n, err := replay.reader.Read(dst);
+    if(!replay.overflowed) {
+        if(len(replay.data) + n > replay.maxSize || (replay.hostBytesRead != nil && atomic.LoadInt64(replay.hostBytesRead) > 0)) {
+            replay.overflowed = true;
+            replay.data = nil;
+        } else {
+            replay.data = append(replay.data, dst[:n]...);
+        }
+    }
+    if(err != nil && err != io.EOF) {
+        replay.err = err;
+    }
+    return n, err;
+}
+
+func (replay *ReplayBuffer) replayable() (bool) {
+    return replay != nil && !replay.overflowed && replay.err == nil;
+}
+
+/*============================
+ bandwidthKey
+
+ This procedure returns the key of a bandwidth limit.
+
+ Parameters:
+    scope: "clusterPort" or "hostPort"
+    port: cluster port or host port
+    direction: "in" (client to host port) or "out" (host port to client)
+
+ Returns:
+    Bandwidth limit key
+============================*/
+func bandwidthKey(scope string, port int, direction string) (string) {
+    return fmt.Sprintf("%s:%d:%s", scope, port, direction);
+}
+
+/*============================
+ update
+
+ This procedure applies the bandwidth limits of a ports configuration. Limiters are
+ updated in place, so that active connections follow the new limits right away.
+ A host port takes its own rateIn/rateOut options, the lowest one when it appears
+ in several entries, and a cluster port the options of its cluster port entry.
+
+ Parameters:
+    portsConfiguration: ports configuration
+    clusterPortsOptions: cluster port options
+============================*/
+func (bandwidth *BandwidthLimiters) update(portsConfiguration PortsConfigurationMap, clusterPortsOptions ClusterPortOptionsMap) {
+    var rates map[string]int64 = make(map[string]int64);
+    var setLowest = func(key string, rate int64) {
+        if(rate > 0 && (rates[key] == 0 || rate < rates[key])) {
+            rates[key] = rate;
+        }
+    };
+    var ports []PortsConfigurationData;
+    var portsData PortsConfigurationData;
+    for _, ports = range portsConfiguration {
+        for _, portsData = range ports {
+            setLowest(bandwidthKey("hostPort", portsData.hostPort, "in"), portsData.rateIn);
+            setLowest(bandwidthKey("hostPort", portsData.hostPort, "out"), portsData.rateOut);
+        }
+    }
+    var clusterPort int;
+    var clusterPortOptions ClusterPortOptions;
+    for clusterPort, clusterPortOptions = range clusterPortsOptions {
+        setLowest(bandwidthKey("clusterPort", clusterPort, "in"), clusterPortOptions.rateIn);
+        setLowest(bandwidthKey("clusterPort", clusterPort, "out"), clusterPortOptions.rateOut);
+    }
+
+    bandwidth.lock.Lock();
+    defer bandwidth.lock.Unlock();
+    bandwidth.rates = rates;
+    var key string;
+    var limiter *ByteRateLimiter;
+    for key, limiter = range bandwidth.limiters {
+        limiter.setRate(rates[key]);
+    }
+}
+
+/*============================
+ get
+
+ This procedure returns the limiters shared by all connections of a host port or of
+ a cluster port, see bandwidthKey.
+
+ Parameters:
+    keys: bandwidth limit keys
+
+ Returns:
+    One limiter per key
+============================*/
+func (bandwidth *BandwidthLimiters) get(keys ...string) ([]*ByteRateLimiter) {
+    bandwidth.lock.Lock();
+    defer bandwidth.lock.Unlock();
+    var limiters []*ByteRateLimiter;
+    var key string;
+    for _, key = range keys {
+        var limiter *ByteRateLimiter = bandwidth.limiters[key];
+        if(limiter == nil) {
+            limiter = &ByteRateLimiter{rate: bandwidth.rates[key]};
+            bandwidth.limiters[key] = limiter;
+        }
+        limiters = append(limiters, limiter);
+    }
+    return limiters;
+}
+
+func (limiter *ByteRateLimiter) setRate(rate int64) {
+    limiter.lock.Lock();
+    defer limiter.lock.Unlock();
+    limiter.rate = rate;
+}
+
+/*============================
+ chunkSize
+
+ This procedure returns how many bytes may be read at once under the limit, so
+ that throttled connections are paced in small steps rather than long pauses.
+
+ Parameters:
+    size: requested size
+
+ Returns:
+    Allowed size, a tenth of the rate at most
+============================*/
+func (limiter *ByteRateLimiter) chunkSize(size int) (int) {
+    limiter.lock.Lock();
+    defer limiter.lock.Unlock();
+    if(limiter.rate <= 0) {
+        return size;
+    }
+    var chunk int64 = limiter.rate / 10;
+    if(chunk < 512) {
+        chunk = 512;
+    }
+    if(int64(size) > chunk) {
+        return int(chunk);
+    }
+    return size;
+}
+
+/*============================
+ wait
+
+ This procedure accounts bytes transferred under the limit, and waits for as long
+ as the limit requires. The limiter is a token bucket holding up to one second of
+ traffic, shared by all the connections it applies to: transfers take tokens in
+ advance, and the following ones wait for the debt to be paid off.
+
+ Parameters:
+    count: number of bytes transferred
+============================*/
+func (limiter *ByteRateLimiter) wait(count int) {
+    limiter.lock.Lock();
+    if(limiter.rate <= 0) {
+        limiter.tokens = 0;
+        limiter.lock.Unlock();
+        return;
+    }
+    var now time.Time = time.Now();
+    var rate float64 = float64(limiter.rate);
+    limiter.tokens = math.Min(rate, limiter.tokens + now.Sub(limiter.updated).Seconds() * rate);
+    limiter.updated = now;
+    limiter.tokens -= float64(count);
+    var delay time.Duration;
+    if(limiter.tokens < 0) {
+        delay = time.Duration(-limiter.tokens / rate * float64(time.Second));
+    }
+    limiter.lock.Unlock();
+    time.Sleep(delay);
+}
+
+func (reader *ThrottledReader) Read(data []byte) (int, error) {
+    var size int = len(data);
+    var limiter *ByteRateLimiter;
+    for _, limiter = range reader.limiters {
+        size = limiter.chunkSize(size);
+    }
+    var count, err = reader.Reader.Read(data[:size]);
+    for _, limiter = range reader.limiters {
+        limiter.wait(count);
+    }
+    return count, err;
+}
+
+/*============================
+ forwardConnections
+
+ This procedure proxies traffic between a client connection and a host connection.
+ When the client is done sending, the host write side is closed so that it can still
+ reply. Both connections are closed as soon as the host is done sending, either side
+ fails, no data flows for longer than the idle timeout or the connection outlives
+ its maximum lifetime.
+ When given a replay buffer, and the host hangs up before sending anything, only the
+ host connection is closed as long as the client data can still be replayed, so that
+ the client connection can be handed over to another host.
+
+ Parameters:
+    clientConnection: connection accepted from the client
+    clientReader: reader for client data, possibly holding buffered data
+    hostConnection: connection established to the host
+    hostReader: reader for host data, possibly holding buffered data
+    timeouts: timeouts in effect for the connection
+    replay: replay buffer of the client data read through clientReader, or nil
+
+ Returns:
+    Amount of data exchanged, whether the host hung up before sending anything
+    while the client was still expecting a reply, and whether the client connection
+    was left open to retry another host
+============================*/
+func forwardConnections(clientConnection net.Conn, clientReader io.Reader, hostConnection net.Conn, hostReader io.Reader, timeouts TimeoutSettings, replay *ReplayBuffer) (ForwardResult) {
+    var lastActivity int64 = time.Now().UnixNano();
+    var done chan struct{} = make(chan struct{});
+    var closeOnce sync.Once;
+    var closedByHost bool = false;
+    var closed int32 = 0;
+    var closeConnections = func(byHost bool) {
+        closeOnce.Do(func() {
+            atomic.StoreInt32(&closed, 1);
+            closedByHost = byHost;
+            clientConnection.Close();
+            hostConnection.Close();
+        });
+    };
+
+    // On host side failures, let the output decide whether the client is to be kept
+    var abortHost = func() {
+        if(replay != nil) {
+            hostConnection.Close();
+        } else {
+            closeConnections(false);
+        }
+    };
+
+    // Enforce maximum connection lifetime
+    if(timeouts.maxConnectionLifetime > 0) {
+        var lifetimeTimer *time.Timer = time.AfterFunc(timeouts.maxConnectionLifetime, func() {
+            log.Printf("Closing connection %s: reached maximum lifetime (%v)", clientConnection.RemoteAddr(), timeouts.maxConnectionLifetime);
+            closeConnections(false);
+        });
+        defer lifetimeTimer.Stop();
+    }
+
+    // Enforce idle timeout
+    if(timeouts.idleTimeout > 0) {
+        var checkInterval time.Duration = time.Second;
+        if(timeouts.idleTimeout / 2 < checkInterval) {
+            checkInterval = timeouts.idleTimeout / 2;
+        }
+        go func() {
+            var ticker *time.Ticker = time.NewTicker(checkInterval);
+            defer ticker.Stop();
+            for {
+                select {
+                    case <-done:
+                        return;
+                    case now := <-ticker.C:
+                        if(now.Sub(time.Unix(0, atomic.LoadInt64(&lastActivity))) >= timeouts.idleTimeout) {
+                            log.Printf("Closing connection %s: idle for %v", clientConnection.RemoteAddr(), timeouts.idleTimeout);
+                            closeConnections(false);
+                            return;
+                        }
                 }
-
             }
+        } ();
+    }
 
-        }
+    // Release the replay buffer once the host has replied
+    var hostBytesRead int64 = 0;
+    if(replay != nil) {
+        replay.hostBytesRead = &hostBytesRead;
+    }
 
-        // In case of error during Scan(), expect to catch error here
-        var err error = nil;
-        err = scanner.Err();
+    // Input: send data from client to host
+    var result ForwardResult;
+    var clientFinished int32 = 0;
+    var waitGroup sync.WaitGroup;
+    waitGroup.Add(1);
+    go func() {
+        defer waitGroup.Done();
+        var err error;
+        result.bytesToHost, err = io.Copy(hostConnection, ActivityReader{clientReader, &lastActivity, nil});
         if(err != nil) {
-            log.Printf("Error reading from file: %v", err);
-            os.Exit(1);
+            log.Printf("Error copying data from client to host: %v", err);
+            abortHost();
+            return;
+        }
+        // Client is done sending, let the host finish replying
+        atomic.StoreInt32(&clientFinished, 1);
+        var closer, ok = hostConnection.(closeWriter);
+        if(!ok || closer.CloseWrite() != nil) {
+            abortHost();
         }
+    } ();
 
-        // Otherwise, assume data is in good condition
-        return data;
-    } (cfgFile);
+    // Output: send data from host back to the client
+    var err error;
+    result.bytesToClient, err = io.Copy(clientConnection, ActivityReader{hostReader, &lastActivity, &hostBytesRead});
+    if(err != nil) {
+        log.Printf("Error copying data from host to client: %v", err);
+    }
 
-    // Return loaded configuration data
-    return programSettings;
+    // Host hung up without replying: stop reading from the client and keep it open,
+    // unless its data can no longer be replayed. A host which sent any byte, even one
+    // the client did not get, may have acted on the data: it is never retried.
+    if(replay != nil && atomic.LoadInt64(&hostBytesRead) == 0 && atomic.LoadInt32(&closed) == 0) {
+        hostConnection.Close();
+        clientConnection.SetReadDeadline(time.Now());
+        waitGroup.Wait();
+        clientConnection.SetReadDeadline(time.Time{});
+        var netErr, isNetErr = replay.err.(net.Error);
+        if(isNetErr && netErr.Timeout()) {
+            replay.err = nil;
+        }
+        if(replay.replayable() && atomic.LoadInt32(&closed) == 0) {
+            close(done);
+            result.hostClosedEarly = true;
+            result.retry = true;
+            return result;
+        }
+    }
+    closeConnections(true);
+    waitGroup.Wait();
+    close(done);
+
+    // A client which hung up without sending anything is not the host fault
+    result.hostClosedEarly = closedByHost && result.bytesToClient == 0 && (result.bytesToHost > 0 || atomic.LoadInt32(&clientFinished) == 0);
+    return result;
+}
+
+/*============================
+ metricsLabels
+
+ This procedure formats metric labels out of a list of name and value pairs.
+
+ Parameters:
+    pairs: label names and values, alternated
+
+ Returns:
+    Formatted labels, e.g. {clusterPort="29999",pod="pod-a"}
+============================*/
+func metricsLabels(pairs ...string) (string) {
+    var labels []string;
+    var index int;
+    for index = 0; index+1 < len(pairs); index += 2 {
+        labels = append(labels, fmt.Sprintf("%s=%q", pairs[index], pairs[index+1]));
+    }
+    return "{" + strings.Join(labels, ",") + "}";
+}
+
+func (metrics *Metrics) add(name string, labels string, value int64) {
+    metrics.lock.Lock();
+    defer metrics.lock.Unlock();
+    metrics.values[name + labels] += value;
+}
+
+func (metrics *Metrics) setRatio(name string, labels string, value float64) {
+    metrics.lock.Lock();
+    defer metrics.lock.Unlock();
+    metrics.ratios[name + labels] = value;
+}
+
+/*============================
+ write
+
+ This procedure writes all metrics, sorted by name, in Prometheus text format.
+
+ Parameters:
+    writer: output
+============================*/
+func (metrics *Metrics) write(writer io.Writer) {
+    metrics.lock.Lock();
+    var names []string = make([]string, 0, len(metrics.values) + len(metrics.ratios));
+    var name string;
+    for name = range metrics.values {
+        names = append(names, name);
+    }
+    for name = range metrics.ratios {
+        names = append(names, name);
+    }
+    sort.Strings(names);
+    var lines bytes.Buffer;
+    for _, name = range names {
+        var ratio, isRatio = metrics.ratios[name];
+        if(isRatio) {
+            fmt.Fprintf(&lines, "%s %.4f\n", name, ratio);
+        } else {
+            fmt.Fprintf(&lines, "%s %d\n", name, metrics.values[name]);
+        }
+    }
+    metrics.lock.Unlock();
+    writer.Write(lines.Bytes());
+}
+
+/*============================
+ register
+
+ This procedure records an active connection to a host port.
+
+ Parameters:
+    info: connection details
+
+ Returns:
+    Connection identifier, to be given back to unregister
+============================*/
+func (registry *ConnectionRegistry) register(info *ConnectionInfo) (int64) {
+    registry.lock.Lock();
+    defer registry.lock.Unlock();
+    registry.nextId++;
+    registry.connections[registry.nextId] = info;
+    return registry.nextId;
+}
+
+func (registry *ConnectionRegistry) unregister(id int64) {
+    registry.lock.Lock();
+    defer registry.lock.Unlock();
+    delete(registry.connections, id);
+}
+
+/*============================
+ setDrained
+
+ This procedure marks a pod as drained, so that no new connections are routed
+ to it, or clears the mark. Active connections are left untouched.
+
+ Parameters:
+    podId: pod identifier
+    drained: whether the pod is drained
+============================*/
+func (registry *ConnectionRegistry) setDrained(podId string, drained bool) {
+    registry.lock.Lock();
+    defer registry.lock.Unlock();
+    if(drained) {
+        registry.drainedPods[podId] = true;
+    } else {
+        delete(registry.drainedPods, podId);
+    }
+}
+
+func (registry *ConnectionRegistry) isDrained(podId string) (bool) {
+    if(podId == "") {
+        return false;
+    }
+    registry.lock.Lock();
+    defer registry.lock.Unlock();
+    return registry.drainedPods[podId];
+}
+
+/*============================
+ kill
+
+ This procedure closes all active connections of a pod.
+
+ Parameters:
+    podId: pod identifier
+
+ Returns:
+    Number of connections closed
+============================*/
+func (registry *ConnectionRegistry) kill(podId string) (int) {
+    var killed []*ConnectionInfo;
+    registry.lock.Lock();
+    var info *ConnectionInfo;
+    for _, info = range registry.connections {
+        if(info.podId == podId) {
+            killed = append(killed, info);
+        }
+    }
+    registry.lock.Unlock();
+
+    for _, info = range killed {
+        log.Printf("Killing connection from %s to host port %d (pod %s)", info.client, info.hostPort, info.podId);
+        info.clientConnection.Close();
+        info.hostConnection.Close();
+    }
+    return len(killed);
+}
+
+/*============================
+ write
+
+ This procedure writes one line per active connection, sorted by identifier.
+
+ Parameters:
+    writer: output
+============================*/
+func (registry *ConnectionRegistry) write(writer io.Writer) {
+    registry.lock.Lock();
+    var ids []int64 = make([]int64, 0, len(registry.connections));
+    var id int64;
+    for id = range registry.connections {
+        ids = append(ids, id);
+    }
+    sort.Slice(ids, func(i int, j int) (bool) { return ids[i] < ids[j]; });
+    var lines bytes.Buffer;
+    for _, id = range ids {
+        var info *ConnectionInfo = registry.connections[id];
+        fmt.Fprintf(&lines, "%d clusterPort=%d hostPort=%d pod=%s client=%s age=%v\n", id, info.clusterPort, info.hostPort, info.podId, info.client, time.Since(info.startTime).Round(time.Second));
+    }
+    registry.lock.Unlock();
+    writer.Write(lines.Bytes());
+}
+
+/*============================
+ handleAdminConnection
+
+ This procedure serves a connection to the admin listener. Commands are read
+ one per line, and each reply ends with an "ok" or "error: <reason>" line. When
+ an admin token is set, the first line must be "auth <token>", otherwise the
+ connection is closed.
+
+ Commands:
+    connections: list active connections to host ports
+    pods: list configured pods with their cluster and host ports
+    metrics: dump all metrics
+    drain <podId>: stop routing new connections to a pod
+    undrain <podId>: resume routing new connections to a pod
+    kill <podId>: close all active connections of a pod
+
+ Parameters:
+    connection: admin connection
+    registry: active connections registry
+    metrics: metrics
+    portsConfiguration: getter for the current ports configuration
+    token: admin token, empty when not required
+============================*/
+func handleAdminConnection(connection net.Conn, registry *ConnectionRegistry, metrics *Metrics, portsConfiguration func() (PortsConfigurationMap), token []byte) {
+    defer connection.Close();
+    var scanner *bufio.Scanner = bufio.NewScanner(connection);
+    if(len(token) > 0) {
+        // The token line is never logged
+        if(!scanner.Scan() || !hmac.Equal([]byte(scanner.Text()), append([]byte("auth "), token...))) {
+            log.Printf("[admin] Rejected connection %s: invalid admin token", connection.RemoteAddr());
+            io.WriteString(connection, "error: unauthorized\n");
+            return;
+        }
+        io.WriteString(connection, "ok\n");
+    }
+    for scanner.Scan() {
+        var command []string = strings.Fields(scanner.Text());
+        if(len(command) == 0) {
+            continue;
+        }
+        log.Printf("[admin] Command from %s: %v", connection.RemoteAddr(), command);
+        switch {
+            case command[0] == "connections" && len(command) == 1:
+                registry.write(connection);
+            case command[0] == "pods" && len(command) == 1:
+                var clusterPorts []int;
+                var clusterPort int;
+                var configuration PortsConfigurationMap = portsConfiguration();
+                for clusterPort = range configuration {
+                    clusterPorts = append(clusterPorts, clusterPort);
+                }
+                sort.Ints(clusterPorts);
+                for _, clusterPort = range clusterPorts {
+                    var portsData PortsConfigurationData;
+                    for _, portsData = range configuration[clusterPort] {
+                        fmt.Fprintf(connection, "pod=%s clusterPort=%d hostPort=%d drained=%t\n", portsData.podId, clusterPort, portsData.hostPort, registry.isDrained(portsData.podId));
+                    }
+                }
+            case command[0] == "metrics" && len(command) == 1:
+                metrics.write(connection);
+            case command[0] == "drain" && len(command) == 2:
+                registry.setDrained(command[1], true);
+            case command[0] == "undrain" && len(command) == 2:
+                registry.setDrained(command[1], false);
+            case command[0] == "kill" && len(command) == 2:
+                fmt.Fprintf(connection, "killed=%d\n", registry.kill(command[1]));
+            default:
+                io.WriteString(connection, "error: unknown command\n");
+                continue;
+        }
+        io.WriteString(connection, "ok\n");
+    }
+}
+
+/*============================
+ isLoopbackHost
+
+ This procedure checks whether a listener host only accepts local connections.
+
+ Parameters:
+    host: listener host, empty for all interfaces
+
+ Returns:
+    True for "localhost" and loopback addresses, false otherwise
+============================*/
+func isLoopbackHost(host string) (bool) {
+    if(host == "localhost") {
+        return true;
+    }
+    var ip net.IP = net.ParseIP(host);
+    return ip != nil && ip.IsLoopback();
 }
 
 func loadListener(networkMode string, clusterAddress string, previousPortsConfiguration ConfigurationMap, newPortsConfiguration ConfigurationMap, currentListeners *map[int]net.Listener) () {
@@ -700,6 +3878,18 @@ func main() {
     const networkMode string = "tcp";
     var listenerHost string = programSettings.listenerHost;
     var listenerPort int = programSettings.listenerPort;
+    var localZone string = programSettings.zone;
+    var hostsSelection string = programSettings.hostsSelection;
+    var mirrorBufferSize int = programSettings.mirrorBufferSize;
+    if(mirrorBufferSize <= 0) {
+        mirrorBufferSize = 1024 * 1024;
+    }
+    var retryOnEarlyClose bool = programSettings.retryOnEarlyClose;
+    var replayBufferSize int = programSettings.replayBufferSize;
+    if(replayBufferSize <= 0) {
+        replayBufferSize = 64 * 1024;
+    }
+    rand.Seed(time.Now().UnixNano());
 
     // Cluster settings (in)
     // Host settings (out)
@@ -710,7 +3900,7 @@ func main() {
     var listeners map[int]net.Listener;
     listeners = make(map[int]net.Listener);
 
-    var newPortsConfiguration PortsConfigurationMap = loadPortsConfiguration(portsConfigurationFile);
+    var newPortsConfiguration, clusterPortsOptions = loadPortsConfiguration(portsConfigurationFile);
     if(newPortsConfiguration == nil) {
         log.Printf("Error reading ports configuration file. Expected initial configuration to be valid");
         os.Exit(1);
@@ -724,6 +3914,69 @@ func main() {
     }
     log.Printf("Hosts configuration: %v\n", hostsConfiguration);
 
+    // Ports and hosts configurations are swapped as a whole on reloads, while connections,
+    // health checks and host name resolution read them
+    var currentPortsConfiguration atomic.Value;
+    currentPortsConfiguration.Store(newPortsConfiguration);
+    var currentHostsConfiguration atomic.Value;
+    currentHostsConfiguration.Store(hostsConfiguration);
+
+    // Access control rules are swapped as a whole on reloads, while connections read them
+    var accessControl atomic.Value;
+    accessControl.Store(AccessControlMap(nil));
+    if(programSettings.accessControlFile != "") {
+        var configuration, err = loadAccessControl(programSettings.accessControlFile);
+        if(err != nil) {
+            log.Printf("Error reading access control file %s: %v", programSettings.accessControlFile, err);
+            os.Exit(1);
+        }
+        accessControl.Store(configuration);
+        log.Printf("Access control: %d cluster ports with rules\n", len(configuration));
+    }
+
+    // Set up hosts name resolution
+    var hostsResolver *HostsResolver = &HostsResolver{addresses: make(map[string][]string)};
+    hostsResolver.refresh(hostsConfiguration);
+    var hostsResolveInterval time.Duration = programSettings.hostsResolveInterval;
+    if(hostsResolveInterval <= 0) {
+        hostsResolveInterval = 30 * time.Second;
+    }
+
+    // Set up mutual TLS between proxies
+    var certificateStore *CertificateStore;
+    if(programSettings.tlsCertificateFile != "" || programSettings.tlsKeyFile != "" || programSettings.tlsCaFile != "") {
+        certificateStore = &CertificateStore{
+            certificateFile: programSettings.tlsCertificateFile,
+            keyFile: programSettings.tlsKeyFile,
+            caFile: programSettings.tlsCaFile,
+            modTimes: make(map[string]time.Time),
+        };
+        var err error = certificateStore.load();
+        if(err != nil) {
+            log.Printf("Error loading TLS files: %v", err);
+            os.Exit(1);
+        }
+    }
+
+    if(len(programSettings.trustedProxyCidrs) == 0) {
+        log.Printf("Warning: trustedProxyCidrs is empty, proxy protocol headers are trusted from any source. Set it to the load balancer addresses so that pods cannot claim arbitrary client addresses");
+    }
+
+    // Set up inter-proxy handshake authentication
+    var authenticator *HandshakeAuthenticator;
+    if(programSettings.authSecretFile != "") {
+        secret, err := ioutil.ReadFile(programSettings.authSecretFile);
+        if(err != nil || len(bytes.TrimSpace(secret)) == 0) {
+            log.Printf("Error reading authentication secret file %s: %v", programSettings.authSecretFile, err);
+            os.Exit(1);
+        }
+        authenticator = &HandshakeAuthenticator{
+            secret: bytes.TrimSpace(secret),
+            maxClockSkew: programSettings.authMaxClockSkew,
+            nonces: make(map[string]time.Time),
+        };
+    }
+
     // Start listener
     // Input : announce and listen to incoming connections
     var listener net.Listener = func(mode string, address string) (net.Listener) {
@@ -733,12 +3986,53 @@ func main() {
             os.Exit(1);
         }
         log.Printf("Listening to %s", address);
+        if(certificateStore != nil) {
+            log.Printf("Requiring mutual TLS on %s", address);
+            return tls.NewListener(listen, &tls.Config{
+                GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+                    return certificateStore.serverConfig(), nil;
+                },
+            });
+        }
         return listen;
     } (networkMode, listenerHost + ":" + strconv.Itoa(listenerPort));
 
     // Set up max connections data
-    var currentHostPortsMaxConnections map[int]int;
-    currentHostPortsMaxConnections = make(map[int]int);
+    var healthChecker *HealthChecker = &HealthChecker{
+        unhealthy: make(map[int]bool),
+        lastCheck: make(map[int]time.Time),
+        checking: make(map[int]bool),
+    };
+    var metrics *Metrics = &Metrics{values: make(map[string]int64), ratios: make(map[string]float64)};
+    var connectionRegistry *ConnectionRegistry = &ConnectionRegistry{
+        connections: make(map[int64]*ConnectionInfo),
+        drainedPods: make(map[string]bool),
+    };
+    var hostPortsBalancer *HostPortsBalancer = &HostPortsBalancer{
+        activeConnectionsCount: make(map[int]int),
+        roundRobinIndex: make(map[int]int),
+        routedConnections: make(map[int]map[int]int64),
+        firstSeen: make(map[int]time.Time),
+        slowStartWindow: programSettings.slowStartWindow,
+    };
+    hostPortsBalancer.track(newPortsConfiguration, true);
+    var newOutlierDetector = func() (*OutlierDetector) {
+        return &OutlierDetector{
+            consecutiveFailures: programSettings.outlierConsecutiveFailures,
+            baseEjectionTime: programSettings.outlierBaseEjectionTime,
+            maxEjectionTime: programSettings.outlierMaxEjectionTime,
+            failures: make(map[string]int),
+            ejections: make(map[string]int),
+            ejectedUntil: make(map[string]time.Time),
+        };
+    };
+    var hostsOutlierDetector *OutlierDetector = newOutlierDetector();
+    var hostPortsOutlierDetector *OutlierDetector = newOutlierDetector();
+    var clientLimiter *ClientLimiter = &ClientLimiter{clients: make(map[string]*ClientBucket)};
+    // Cluster ports keep limits of their own, so that a connection proxied to the local host is not counted twice
+    var clusterClientLimiter *ClientLimiter = &ClientLimiter{clients: make(map[string]*ClientBucket)};
+    var bandwidthLimiters *BandwidthLimiters = &BandwidthLimiters{limiters: make(map[string]*ByteRateLimiter)};
+    bandwidthLimiters.update(newPortsConfiguration, clusterPortsOptions);
 
     // Handle listeners for range of cluster ports
     var clusterPortsRangeMin int = programSettings.clusterPortsRangeMin;
@@ -767,350 +4061,380 @@ func main() {
                     log.Printf("[host] Accepted connection from %s (via %s)", connection.LocalAddr(), connection.RemoteAddr());
                 }
 
-                // Iterate over list of hosts
-                // TODO: handle one at a time iteration
-                //         -> procedures can only be started the previous one signals with OK or FAILURE
-
-                atomic.StoreInt32(&foundValidHost, 0);
-                signalDone := make(chan struct{});
-                var signalDoneMutex int32 = 0;
-                var hostsConfigurationLen int32 = (int32)(len(hostsConfiguration));
-                var hostsConfigurationCounter int32 = 0;
-                var signalNextMutex int32 = 0;
-                // Check presence of proxy protocol
-                var connectionReader *bufio.Reader;
-                var clientIp, proxyIp, clientPort, proxyPort, data = func() (string, string, int, int, []byte) {
-                    var err error;
-                    connectionReader = bufio.NewReader(connection);
-                    var connectionReaderBufferCount int;
-                    var connectionReaderBuffer []byte;
-
-                    var data []byte;
-                    data = []byte("");
-
-                    // Check proxy protocol header
-                    const proxyProtocolHeaderString string = "PROXY ";
-                    const proxyProtocolHeaderStringLen int = len(proxyProtocolHeaderString);
-                    // TODO: FIXME: this could lead to bugs depending on the initial data burst
-                    //connectionReaderBuffer = make([]byte, proxyProtocolHeaderStringLen);
-                    connectionReaderBuffer = make([]byte, 1024);
-                    // Read initial header
-                    connectionReaderBufferCount, err = connectionReader.Read(connectionReaderBuffer);
-                    // Check header buffer is valid, count matches expected length and buffer match expected content
-                    if(err != nil || connectionReaderBufferCount != proxyProtocolHeaderStringLen ||
-                            !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolHeaderString))) {
-                        log.Printf("Error parsing proxy protocol header prefix: %s. Error: %v", connectionReaderBuffer, err);
-                        data = connectionReaderBuffer;
-                        return "", "", 0, 0, data;
-                    }
+                // Handle each connection on its own
+                go func(connection net.Conn) {
+                    var timeouts TimeoutSettings = timeoutsForClusterPort(programSettings, currentClusterPort);
 
-                    // Check case of unknown proxy protocol
-                    const proxyProtocolUnknownString string = "UNKNOWN\r\n";
-                    var proxyProtocolUnknownStringLen int = len(proxyProtocolUnknownString);
-                    connectionReaderBuffer, err = connectionReader.Peek(proxyProtocolUnknownStringLen);
-                    // Check unknwon buffer is valid and data matches expected content
-                    if(err != nil || bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolUnknownString))) {
-                        log.Printf("Error parsing proxy protocol unknown: %v", err);
-                        return "", "", 0, 0, data;
+                    // Only trusted sources may set the client address with a proxy protocol header. Other
+                    // sources, and cluster ports with proxyHeaderTimeout disabled, are proxied without waiting
+                    // for client data, so that protocols where the server speaks first are not stalled.
+                    var trustedSource bool = len(programSettings.trustedProxyCidrs) == 0 || isAllowedSource(connection.RemoteAddr(), nil, programSettings.trustedProxyCidrs);
+                    var waitForHeader bool = trustedSource && timeouts.proxyHeaderTimeout > 0;
+
+                    // Bound the time given to the client to send its proxy protocol header
+                    if(waitForHeader) {
+                        connection.SetReadDeadline(time.Now().Add(timeouts.proxyHeaderTimeout));
                     }
 
-                    // Check TCP4 proxy protocol case
-                    // Reference: "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n"
-                    // TODO: add support to TCP6
-                    const proxyProtocolTCP4String string = "TCP4 ";
-                    const proxyProtocolTCP4StringLen int = len(proxyProtocolTCP4String);
-                    connectionReaderBuffer = make([]byte, proxyProtocolTCP4StringLen);
-                    connectionReaderBufferCount, err = connectionReader.Read(connectionReaderBuffer)
+                    // Check presence of proxy protocol
+                    var connectionReader *bufio.Reader;
+                    var headerSeen bool = false;
+                    var headerError error;
+                    var clientProxyHeader string;
+                    var clientIp, proxyIp, clientPort, proxyPort = func() (string, string, int, int) {
+                        var err error;
+                        // Size the reader so that client data sent along with the header may all be replayed
+                        connectionReader = bufio.NewReaderSize(connection, proxyProtocolMaxHeaderLength + replayBufferSize);
+                        var connectionReaderBufferCount int;
+                        var connectionReaderBuffer []byte;
+                        if(!waitForHeader) {
+                            return "", "", 0, 0;
+                        }
+
+                        // Check proxy protocol header, leaving client data unread when there is none
+                        const proxyProtocolHeaderStringLen int = len("PROXY ");
+                        var found bool;
+                        found, err = hasProxyProtocolPrefix(connectionReader);
+                        if(!found) {
+                            log.Printf("No proxy protocol header from %s. Error: %v", connection.RemoteAddr(), err);
+                            return "", "", 0, 0;
+                        }
+
+                        // Read the whole header line first, so that parsing never waits for, nor reads past, the header
+                        headerSeen = true;
+                        var proxyProtocolHeaderLine string;
+                        proxyProtocolHeaderLine, headerError = readHeaderLine(connectionReader, proxyProtocolMaxHeaderLength);
+                        if(headerError != nil) {
+                            log.Printf("Error reading proxy protocol header from %s: %v", connection.RemoteAddr(), headerError);
+                            return "", "", 0, 0;
+                        }
+                        clientProxyHeader = strings.TrimRight(proxyProtocolHeaderLine, "\r\n");
+                        var headerReader *bufio.Reader = bufio.NewReader(strings.NewReader(proxyProtocolHeaderLine[proxyProtocolHeaderStringLen:]));
+
+                        // Check case of unknown proxy protocol: the actual connection addresses are used instead
+                        const proxyProtocolUnknownString string = "UNKNOWN";
+                        if(strings.HasPrefix(proxyProtocolHeaderLine[proxyProtocolHeaderStringLen:], proxyProtocolUnknownString)) {
+                            log.Printf("Proxy protocol unknown from %s", connection.RemoteAddr());
+                            headerSeen = false;
+                            return "", "", 0, 0;
+                        }
+
+                        // Check TCP4 and TCP6 proxy protocol cases
+                        // Reference: "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n"
+                        // Reference: "PROXY TCP6 ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
+                        const proxyProtocolTCP4String string = "TCP4 ";
+                        const proxyProtocolTCP6String string = "TCP6 ";
+                        const proxyProtocolInetStringLen int = len(proxyProtocolTCP4String);
+                        connectionReaderBuffer = make([]byte, proxyProtocolInetStringLen);
+                        connectionReaderBufferCount, err = io.ReadFull(headerReader, connectionReaderBuffer);
                         // Check buffer is valid, count matches expected length and buffer matches expected content
-                        if(err != nil || connectionReaderBufferCount != proxyProtocolTCP4StringLen ||
-                                !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolTCP4String))) {
+                        if(err != nil || connectionReaderBufferCount != proxyProtocolInetStringLen ||
+                                (!bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolTCP4String)) && !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolTCP6String)))) {
                             log.Printf("Error parsing proxy protocol inet protocol: %s. Error: %v", connectionReaderBuffer, err);
-                            return "", "", 0, 0, data;
+                            return "", "", 0, 0;
                         }
 
-                    // Read client IP address
-                    var proxyProtocolClientIpString string;
-                    proxyProtocolClientIpString, err = connectionReader.ReadString(' ');
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol client IP: %v", err);
-                        return "", "", 0, 0, data;
-                    }
-                    // Adjust string
-                    var proxyProtocolClientIpStringLen int;
-                    proxyProtocolClientIpStringLen = len(proxyProtocolClientIpString);
-                    proxyProtocolClientIpString = proxyProtocolClientIpString[:proxyProtocolClientIpStringLen-1];
-                    // Parse IP
-                    var proxyProtocolClientIp net.IP;
-                    proxyProtocolClientIp = net.ParseIP(proxyProtocolClientIpString);
-                    if(proxyProtocolClientIp == nil) {
-                        log.Printf("Error parsing client IP: %s", proxyProtocolClientIpString);
-                        return "", "", 0, 0, data;
-                    }
+                        // Read client IP address
+                        var proxyProtocolClientIpString string;
+                        proxyProtocolClientIpString, err = headerReader.ReadString(' ');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol client IP: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust string
+                        var proxyProtocolClientIpStringLen int;
+                        proxyProtocolClientIpStringLen = len(proxyProtocolClientIpString);
+                        proxyProtocolClientIpString = proxyProtocolClientIpString[:proxyProtocolClientIpStringLen-1];
+                        // Parse IP
+                        var proxyProtocolClientIp net.IP;
+                        proxyProtocolClientIp = net.ParseIP(proxyProtocolClientIpString);
+                        if(proxyProtocolClientIp == nil) {
+                            log.Printf("Error parsing client IP: %s", proxyProtocolClientIpString);
+                            return "", "", 0, 0;
+                        }
 
-                    // Read proxy IP address
-                    var proxyProtocolProxyIpString string;
-                    proxyProtocolProxyIpString, err = connectionReader.ReadString(' ');
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol proxy IP: %v", err);
-                        return "", "", 0, 0, data;
-                    }
-                    // Adjust string
-                    var proxyProtocolProxyIpStringLen int;
-                    proxyProtocolProxyIpStringLen = len(proxyProtocolProxyIpString);
-                    proxyProtocolProxyIpString = proxyProtocolProxyIpString[:proxyProtocolProxyIpStringLen-1];
-                    // Parse IP
-                    var proxyProtocolProxyIp net.IP;
-                    proxyProtocolProxyIp = net.ParseIP(proxyProtocolProxyIpString);
-                    if(proxyProtocolProxyIp == nil) {
-                        log.Printf("Error parsing proxy IP: %s", proxyProtocolClientIpString);
-                        return "", "", 0, 0, data;
-                    }
+                        // Read proxy IP address
+                        var proxyProtocolProxyIpString string;
+                        proxyProtocolProxyIpString, err = headerReader.ReadString(' ');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol proxy IP: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust string
+                        var proxyProtocolProxyIpStringLen int;
+                        proxyProtocolProxyIpStringLen = len(proxyProtocolProxyIpString);
+                        proxyProtocolProxyIpString = proxyProtocolProxyIpString[:proxyProtocolProxyIpStringLen-1];
+                        // Parse IP
+                        var proxyProtocolProxyIp net.IP;
+                        proxyProtocolProxyIp = net.ParseIP(proxyProtocolProxyIpString);
+                        if(proxyProtocolProxyIp == nil) {
+                            log.Printf("Error parsing proxy IP: %s", proxyProtocolClientIpString);
+                            return "", "", 0, 0;
+                        }
 
-                    // Read client port number
-                    var proxyProtocolClientPortString string;
-                    proxyProtocolClientPortString, err = connectionReader.ReadString(' ');
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol client port: %v", err);
-                        return "", "", 0, 0, data;
-                    }
-                    // Adjust number
-                    var proxyProtocolClientPortStringLen int;
-                    proxyProtocolClientPortStringLen = len(proxyProtocolClientPortString);
-                    proxyProtocolClientPortString = proxyProtocolClientPortString[:proxyProtocolClientPortStringLen-1];
-                    // Parse port
-                    var proxyProtocolClientPort int;
-                    proxyProtocolClientPort, err = strconv.Atoi(proxyProtocolClientPortString);
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol client port: %v", err);
-                        return "", "", 0, 0, data;
-                    }
+                        // Read client port number
+                        var proxyProtocolClientPortString string;
+                        proxyProtocolClientPortString, err = headerReader.ReadString(' ');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol client port: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust number
+                        var proxyProtocolClientPortStringLen int;
+                        proxyProtocolClientPortStringLen = len(proxyProtocolClientPortString);
+                        proxyProtocolClientPortString = proxyProtocolClientPortString[:proxyProtocolClientPortStringLen-1];
+                        // Parse port
+                        var proxyProtocolClientPort int;
+                        proxyProtocolClientPort, err = strconv.Atoi(proxyProtocolClientPortString);
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol client port: %v", err);
+                            return "", "", 0, 0;
+                        }
 
-                    // Read proxy port number
-                    var proxyProtocolProxyPortString string;
-                    proxyProtocolProxyPortString, err = connectionReader.ReadString('\r');
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol proxy port: %v", err);
-                        return "", "", 0, 0, data;
-                    }
-                    // Adjust number
-                    var proxyProtocolProxyPortStringLen int;
-                    proxyProtocolProxyPortStringLen = len(proxyProtocolProxyPortString);
-                    proxyProtocolProxyPortString = proxyProtocolProxyPortString[:proxyProtocolProxyPortStringLen-1];
-                    // Parse port
-                    var proxyProtocolProxyPort int;
-                    proxyProtocolProxyPort, err = strconv.Atoi(proxyProtocolProxyPortString);
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol proxy port: %v", err);
-                        return "", "", 0, 0, data;
-                    }
+                        // Read proxy port number
+                        var proxyProtocolProxyPortString string;
+                        proxyProtocolProxyPortString, err = headerReader.ReadString('\r');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol proxy port: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust number
+                        var proxyProtocolProxyPortStringLen int;
+                        proxyProtocolProxyPortStringLen = len(proxyProtocolProxyPortString);
+                        proxyProtocolProxyPortString = proxyProtocolProxyPortString[:proxyProtocolProxyPortStringLen-1];
+                        // Parse port
+                        var proxyProtocolProxyPort int;
+                        proxyProtocolProxyPort, err = strconv.Atoi(proxyProtocolProxyPortString);
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol proxy port: %v", err);
+                            return "", "", 0, 0;
+                        }
 
-                    // Read trailing characters
-                    var proxyProtocolTrailingByte byte;
-                    proxyProtocolTrailingByte, err = connectionReader.ReadByte();
-                    if(err != nil || proxyProtocolTrailingByte != '\n') {
-                        log.Printf("Error parsing proxy protocol trailing byte: %v", err);
-                        return "", "", 0, 0, data;
-                    }
+                        // Read trailing characters
+                        var proxyProtocolTrailingByte byte;
+                        proxyProtocolTrailingByte, err = headerReader.ReadByte();
+                        if(err != nil || proxyProtocolTrailingByte != '\n') {
+                            log.Printf("Error parsing proxy protocol trailing byte: %v", err);
+                            return "", "", 0, 0;
+                        }
+
+                        return proxyProtocolClientIpString, proxyProtocolProxyIpString, proxyProtocolClientPort, proxyProtocolProxyPort;
+                    } ();
+                    connection.SetReadDeadline(time.Time{});
 
-                    return proxyProtocolClientIpString, proxyProtocolProxyIpString, proxyProtocolClientPort, proxyProtocolProxyPort, data;
-                } ();
+                    // Stalled, oversized or malformed proxy protocol header
+                    if(headerSeen && proxyPort == 0) {
+                        var reason string = headerErrorReason(headerError);
+                        log.Printf("[host] Rejecting connection %s: %s", connection.RemoteAddr(), reason);
+                        metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(currentClusterPort), "reason", reason), 1);
+                        connection.Close();
+                        return;
+                    }
 
-                log.Printf("[host] Iterating over hosts configuration: %v", hostsConfiguration);
-                for ip, port := range hostsConfiguration {
-                    signalNext := make(chan struct{});
-                    atomic.StoreInt32(&signalNextMutex, 0);
+                    // Untrusted sources may still start with a proxy protocol header: leave it to the payload
+                    // and use the actual peer address instead, or reject the connection on the first client read
+                    var clientSource io.Reader = connectionReader;
+                    var headerGuard *ProxyHeaderGuard;
+                    if(!trustedSource && programSettings.untrustedProxyHeaders != "payload") {
+                        headerGuard = &ProxyHeaderGuard{reader: connectionReader};
+                        clientSource = headerGuard;
+
+                        // Reject headers sent right away before trying any host, so that they use up no host port connection.
+                        // The wait is kept short for protocols where the server speaks first, later headers are left to the guard.
+                        connection.SetReadDeadline(time.Now().Add(untrustedHeaderPeekTimeout));
+                        var found, _ = hasProxyProtocolPrefix(connectionReader);
+                        connection.SetReadDeadline(time.Time{});
+                        if(found) {
+                            log.Printf("[host] Rejecting connection %s: untrusted proxy protocol header", connection.RemoteAddr());
+                            metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(currentClusterPort), "reason", "untrusted_header"), 1);
+                            connection.Close();
+                            return;
+                        }
+                    }
 
+                    // Without header, the client is the pod (or peer) connecting to the cluster port
+                    if(proxyPort == 0) {
+                        clientIp, proxyIp, clientPort, _ = connectionAddresses(connection);
+                        proxyPort = currentClusterPort;
+                    }
 
-                    atomic.AddInt32(&hostsConfigurationCounter, 1);
-                    if(atomic.LoadInt32(&foundValidHost) == 1) {
-                        break;
+                    if(!isClientAllowed(accessControl.Load().(AccessControlMap), currentClusterPort, clientIp)) {
+                        log.Printf("[host] Rejecting connection %s: client %s not allowed on cluster port %d", connection.RemoteAddr(), clientIp, currentClusterPort);
+                        metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(currentClusterPort), "reason", "access"), 1);
+                        connection.Close();
+                        return;
                     }
-                    log.Printf("[host] Trying to connect to host: %s:%d", ip, port);
-                    // Transform: forward connection to handler
-                    mode:= networkMode;
-                    address:= ip;
-                    log.Printf("[host] Handling remote connection: %s\n", connection.RemoteAddr());
 
-                    // Pass the connection to handler
-                    if(connection != nil) {
+                    // Keep a single client from using up the connections of the cluster port
+                    var limitReason string = clusterClientLimiter.acquire(currentClusterPort, clientIp, clientLimitsForClusterPort(programSettings, currentClusterPort));
+                    if(limitReason != "") {
+                        log.Printf("[host] Rejecting connection %s: client %s on cluster port %d: %s", connection.RemoteAddr(), clientIp, currentClusterPort, limitReason);
+                        metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(currentClusterPort), "reason", limitReason), 1);
+                        connection.Close();
+                        return;
+                    }
+                    defer clusterClientLimiter.release(currentClusterPort, clientIp);
+
+                    // Iterate over list of hosts, one at a time, until one of them replies "go ahead"
+                    var hostsCandidates []HostsConfigurationData = hostsOutlierDetector.orderHosts(expandHostsAddresses(orderHostsByTopology(currentHostsConfiguration.Load().(HostsConfigurationMap), localZone, hostsSelection), hostsResolver));
+                    log.Printf("[host] Iterating over hosts configuration: %v", hostsCandidates);
+
+                    // Keep client data received so far, to send it to every host tried until one says "go ahead".
+                    // Data not fitting in the buffer is left unread, for the host which commits.
+                    var replay *ReplayBuffer = &ReplayBuffer{reader: clientSource, maxSize: replayBufferSize};
+                    var buffered int = connectionReader.Buffered();
+                    if(buffered > replay.maxSize) {
+                        buffered = replay.maxSize;
+                    }
+                    if(buffered > 0) {
+                        io.ReadFull(replay, make([]byte, buffered));
+                    }
+                    for _, hostData := range hostsCandidates {
+                        log.Printf("[host] Trying to connect to host: %s", hostLabel(hostData));
                         var hostConnection net.Conn;
                         var err error;
 
                         // Try to connect to host
-                        var currentHostPort = port;
-                        var host = address + ":" + strconv.Itoa(currentHostPort);
-
-                        // TODO: FIXME: expose timeout
-                        var hostConnectionTimeout time.Duration;
-                        // TODO: FIXME: error checking
-                        hostConnectionTimeout, _ = time.ParseDuration("1s");
-                        hostConnection, err = net.DialTimeout(mode, host, hostConnectionTimeout);
-                        if(err == nil) {
-                            log.Printf("[host] Connected to %s", host);
-
-                            // Handle internal header communication
-                            log.Printf("[host] Reading back proxy protocol line. inet: tcp | Remote clientip: %s, clientport %d | Proxy proxyip: %s, proxyport: %d\n", clientIp, clientPort, proxyIp, proxyPort);
-                            var proxyLine string;
-                            if(proxyPort == 0) {
-                                proxyLine = fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n%s", currentClusterPort, currentClusterPort, data);
-                            } else {
-                                proxyLine = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", clientIp, proxyIp, clientPort, proxyPort);
+                        var host = net.JoinHostPort(hostData.address, strconv.Itoa(hostData.port));
+                        hostConnection, err = net.DialTimeout(networkMode, host, timeouts.dialTimeout);
+                        if(err != nil) {
+                            log.Printf("[host] Error connecting to %s in mode %s. Message: %v", hostLabel(hostData), networkMode, err);
+                            if(hostsOutlierDetector.recordFailure(host)) {
+                                metrics.add("proxy_outlier_ejections_total", metricsLabels("host", host), 1);
                             }
-                            log.Printf("[host] sending header line: %s", proxyLine);
-                            fmt.Fprintf(hostConnection, proxyLine);
-
-                            // TODO: FIXME: Remove
-                            fmt.Fprintf(connection, ""); // FLUSH
-                            // TODO: FIXME: Remove
-                            fmt.Fprintf(hostConnection, ""); // FLUSH
-
-                            var isConnected int32;
-                            atomic.StoreInt32(&isConnected, 1);
-
-
-                            // Input: Send data from received connection to host
-                            go func(conn net.Conn) {
-                                defer func() {
-                                    log.Printf("[host] Closing input host connection...");
-                                    if(atomic.LoadInt32(&isConnected) == 1) {
-                                        atomic.StoreInt32(&isConnected, 0);
-                                        log.Printf("[host] Closing host connection: %s", hostConnection.RemoteAddr());
-                                        // TODO: FIXME: verify if the right place to call this. Toggle ?
-                                        hostConnection.Close();
-                                        //conn.Close();
-                                        if(atomic.LoadInt32(&signalNextMutex) == 0) {
-                                            atomic.StoreInt32(&signalNextMutex, 1);
-                                            log.Printf("[host] SIGNAL: next entry");
-                                            close(signalNext);
-                                        }
-
-                                        if(atomic.LoadInt32(&signalDoneMutex) == 0) {
-                                            atomic.StoreInt32(&signalDoneMutex, 1);
-                                            log.Printf("[host] SIGNAL: hosts loop is done");
-                                            close(signalDone);
-                                        }
-                                    }
-                                } ();
-
-                                var err error;
-                                clientConnectionWriter := ClientWriter{conn};
-                                signalConnectionReader := SignalReader{hostConnection};
-                                log.Printf("[host] Copying to connection %s and host %s", conn.RemoteAddr(), hostConnection.RemoteAddr());
-                                // TODO: FIXME: Remove
-                                fmt.Fprintf(conn, ""); // FLUSH
-                                // TODO: FIXME: Remove
-                                fmt.Fprintf(hostConnection, ""); // FLUSH
-
-                                _, err = io.Copy(clientConnectionWriter, signalConnectionReader);
-                                if(err != nil) {
-                                    log.Printf("[host] Error copying data from cluster to host: %v", err);
-                                    /*if(atomic.LoadInt32(&foundValidHost) == 1) {
-                                        fmt.Fprintf(conn, "debug1");
-                                    }*/
-
-                                    // TODO: FIXME: Missing call. Leak !? Toggle ?
-                                    //hostConnection.Close();
-/*                                        if(atomic.LoadInt32(&signalDoneMutex) == 0) {
-                                            atomic.StoreInt32(&signalDoneMutex, 1);
-                                            close(signalDone);
-                                        }*/
+                            continue;
+                        }
+                        log.Printf("[host] Connected to %s", hostLabel(hostData));
 
-                                    return;
+                        // Authenticate both proxies
+                        if(certificateStore != nil) {
+                            var tlsConnection *tls.Conn = tls.Client(hostConnection, certificateStore.clientConfig(hostData.host));
+                            tlsConnection.SetDeadline(time.Now().Add(tlsHandshakeTimeout(timeouts)));
+                            err = tlsConnection.Handshake();
+                            if(err != nil) {
+                                log.Printf("[host] Error during TLS handshake with %s: %v", hostLabel(hostData), err);
+                                tlsConnection.Close();
+                                if(hostsOutlierDetector.recordFailure(host)) {
+                                    metrics.add("proxy_outlier_ejections_total", metricsLabels("host", host), 1);
                                 }
-                            }(connection);
-
-                            // Output: send data from host back to the original connection
-                            go func(conn net.Conn) {
-                                defer func() {
-                                    log.Printf("[host] Closing output host connection...");
-                                    if(atomic.LoadInt32(&isConnected) == 1) {
-                                        atomic.StoreInt32(&isConnected, 0);
-                                        log.Printf("[host] Closing host connection: %s", hostConnection.RemoteAddr());
-                                        // TODO: FIXME: verify if the right place to call this. Toggle ?
-                                        hostConnection.Close();
-                                        //conn.Close();
-                                        if(atomic.LoadInt32(&signalNextMutex) == 0) {
-                                            atomic.StoreInt32(&signalNextMutex, 1);
-                                            log.Printf("[host] SIGNAL: next entry");
-                                            close(signalNext);
-                                        }
-
-                                        if(atomic.LoadInt32(&signalDoneMutex) == 0) {
-                                            atomic.StoreInt32(&signalDoneMutex, 1);
-                                            log.Printf("[host] SIGNAL: hosts loop is done");
-                                            close(signalDone);
-                                        }
-                                    }
-                                } ();
-
-                                var err error;
-
-                                // TODO: FIXME: Remove
-                                fmt.Fprintf(conn, ""); // FLUSH
-                                // TODO: FIXME: Remove
-                                fmt.Fprintf(hostConnection, ""); // FLUSH
-                                log.Printf("[host] Copying to hostConnection %s and conn %s", hostConnection.RemoteAddr(), conn.RemoteAddr());
-                                _, err = io.Copy(hostConnection, connectionReader);
-                                if(err != nil) {
-                                    /*if(atomic.LoadInt32(&foundValidHost) == 1) {
-                                        fmt.Fprintf(conn, "debug2");
-                                    }*/
-                                    log.Printf("[host] Error copying data from host to cluster: %v", err);
-                                    // TODO: FIXME: verify if the right place to call this. Toggle ?
-                                    //hostConnection.Close();
-                                    /*if(atomic.LoadInt32(&signalDoneMutex) == 0) {
-                                        atomic.StoreInt32(&signalDoneMutex, 1);
-                                        close(signalDone);
-                                    }*/
+                                continue;
+                            }
+                            hostConnection = tlsConnection;
+                        }
 
-                                    return;
-                                }
-                            }(connection);
-                        } else {
-                            log.Printf("[host] Error connecting to %s in mode %s. Message: %v", host, mode, err);
-                            //err = connection.Close();
-                            if(err != nil) {
-                                log.Printf("[host] Error closing connection: %s. Error: %v", connection.RemoteAddr(), err);
+                        // Handle internal header communication
+                        log.Printf("[host] Reading back proxy protocol line. inet: tcp | Remote clientip: %s, clientport %d | Proxy proxyip: %s, proxyport: %d\n", clientIp, clientPort, proxyIp, proxyPort);
+                        var proxyLine string;
+                        var authLine string;
+                        if(programSettings.internalHeader == "proxy") {
+                            // Legacy header, for clusters still running proxies without internal headers:
+                            // the proxy port stands for the cluster port
+                            var header bytes.Buffer;
+                            writeProxyHeader(&header, 1, clientIp, proxyIp, clientPort, proxyPort);
+                            proxyLine = header.String();
+                            if(authenticator != nil) {
+                                authLine = authenticator.sign(host, handshakeMessage(clientIp, proxyIp, clientPort, proxyPort));
                             }
-                            if(atomic.LoadInt32(&signalNextMutex) == 0) {
-                                log.Printf("[host] Proceeding to next entry");
-                                atomic.StoreInt32(&signalNextMutex, 1);
-                                close(signalNext);
+                        } else {
+                            proxyLine = formatInternalHeader(InternalHeader{
+                                clusterPort: currentClusterPort,
+                                clientIp: clientIp,
+                                clientPort: clientPort,
+                                proxyIp: proxyIp,
+                                proxyPort: proxyPort,
+                                proxyHeader: clientProxyHeader,
+                            });
+                            if(authenticator != nil) {
+                                authLine = authenticator.sign(host, proxyLine);
                             }
+                        }
+                        // The authentication line is never logged: it is only valid for this host, but remains a credential
+                        log.Printf("[host] sending header line: %s", proxyLine);
+                        if(timeouts.handshakeTimeout > 0) {
+                            hostConnection.SetDeadline(time.Now().Add(timeouts.handshakeTimeout));
+                        }
+                        _, err = io.WriteString(hostConnection, proxyLine + authLine);
+                        if(err == nil && len(replay.data) > 0) {
+                            _, err = hostConnection.Write(replay.data);
+                        }
+                        if(err != nil) {
+                            log.Printf("[host] Error sending header line to %s: %v", hostLabel(hostData), err);
+                            hostConnection.Close();
+                            continue;
+                        }
 
-                            var currentHostsConfigurationCounter int32;
-                            currentHostsConfigurationCounter = atomic.LoadInt32(&hostsConfigurationCounter);
-                            if(currentHostsConfigurationCounter >= hostsConfigurationLen) {
-                                log.Printf("No available hosts");
-                                connection.Close();
-                                if(atomic.LoadInt32(&signalDoneMutex) == 0) {
-                                    atomic.StoreInt32(&signalDoneMutex, 1);
-                                    log.Printf("[host] SIGNAL: hosts loop is done");
-                                    close(signalDone);
-                                }
+                        // Read back the mapping status
+                        var hostConnectionReader *bufio.Reader = bufio.NewReader(hostConnection);
+                        var reply string;
+                        reply, err = hostConnectionReader.ReadString('\n');
+                        hostConnection.SetDeadline(time.Time{});
+                        if(err != nil) {
+                            log.Printf("[host] Error reading mapping status from %s: %v", hostLabel(hostData), err);
+                            hostConnection.Close();
+                            if(hostsOutlierDetector.recordFailure(host)) {
+                                metrics.add("proxy_outlier_ejections_total", metricsLabels("host", host), 1);
                             }
+                            continue;
                         }
-                    } else {
-                        log.Printf("[host] Hosts routine for %s, over and out!\n", listener.Addr());
-                        //err = connection.Close();
-                        if(err != nil) {
-                            log.Printf("[host] Error closing connection: %s. Error: %v", connection.RemoteAddr(), err);
+                        if(strings.HasPrefix(reply, responseMappingRejectedPrefix)) {
+                            // The client itself is rejected: other hosts would not take it either
+                            var reason string = strings.TrimSpace(strings.TrimPrefix(reply, responseMappingRejectedPrefix));
+                            log.Printf("[host] Host %s rejected client %s: %s", hostLabel(hostData), clientIp, reason);
+                            metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(currentClusterPort), "reason", reason), 1);
+                            hostsOutlierDetector.recordSuccess(host);
+                            hostConnection.Close();
+                            connection.Close();
+                            return;
+                        }
+                        if(reply != responseMappingActive) {
+                            log.Printf("[host] Not a valid host: %s (%q). Skipping...", hostLabel(hostData), reply);
+                            hostsOutlierDetector.recordSuccess(host);
+                            hostConnection.Close();
+                            continue;
                         }
-                        if(atomic.LoadInt32(&signalNextMutex) == 0) {
-                            atomic.StoreInt32(&signalNextMutex, 1);
-                            log.Printf("[host] SIGNAL: next entry");
-                            close(signalNext);
+
+                        // The host committed: client data is only kept further, within the same limit, to retry on early close
+                        var clientReader io.Reader = clientSource;
+                        var retryReplay *ReplayBuffer;
+                        if(retryOnEarlyClose) {
+                            clientReader = replay;
+                            retryReplay = replay;
+                        } else {
+                            replay = nil;
+                        }
+
+                        // Throttle both directions to the bandwidth limits of the cluster port.
+                        // Limits are looked up on every read, so reloads apply to active connections too.
+                        clientReader = &ThrottledReader{clientReader, bandwidthLimiters.get(bandwidthKey("clusterPort", currentClusterPort, "in"))};
+                        var hostReader io.Reader = &ThrottledReader{hostConnectionReader, bandwidthLimiters.get(bandwidthKey("clusterPort", currentClusterPort, "out"))};
+
+                        // Proxy traffic until either side hangs up
+                        log.Printf("[host] Copying to connection %s and host %s", connection.RemoteAddr(), hostLabel(hostData));
+                        var result ForwardResult = forwardConnections(connection, clientReader, hostConnection, hostReader, timeouts, retryReplay);
+                        if(headerGuard != nil && headerGuard.rejected) {
+                            log.Printf("[host] Rejected connection %s: untrusted proxy protocol header", connection.RemoteAddr());
+                            metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(currentClusterPort), "reason", "untrusted_header"), 1);
+                            hostsOutlierDetector.recordSuccess(host);
+                            return;
+                        }
+                        // The host replied "go ahead", so it had a usable host port: a pod closing early is
+                        // counted against its host port by the remote proxy, not against a healthy host
+                        if(result.hostClosedEarly) {
+                            log.Printf("[host] Host %s closed connection %s before replying", hostLabel(hostData), connection.RemoteAddr());
                         }
+                        hostsOutlierDetector.recordSuccess(host);
+                        if(result.retry) {
+                            log.Printf("[host] Retrying connection %s on the next host", connection.RemoteAddr());
+                            metrics.add("proxy_early_close_retries_total", metricsLabels("host", host), 1);
+                            continue;
+                        }
+                        log.Printf("[host] Closed connection %s to host %s", connection.RemoteAddr(), hostLabel(hostData));
                         return;
                     }
-                    log.Printf("[host] Waiting on signal next. Current host: %v, %v", ip, port);
-                    <-signalNext;
-                    log.Printf("[host] Proceeding to the next host");
-                }
-                log.Printf("[host] Waiting on signal done");
-                <-signalDone;
-                log.Printf("[host] Exhausted all hosts");
-                connection.Close();
+
+                    log.Printf("[host] Exhausted all hosts. No available hosts");
+                    connection.Close();
+                } (connection);
             }
         } (listener, clusterPort);
     }
@@ -1131,263 +4455,439 @@ func main() {
                 log.Printf("Accepted connection from %s (via %s)", connection.LocalAddr(), connection.RemoteAddr());
             }
 
-
             // Transform: forward connection to handler
             go func(conn net.Conn) {
                 log.Printf("Handling remote connection: %s\n", connection.RemoteAddr());
 
-                // Check presence of proxy protocol
-                var connectionReader *bufio.Reader;
-                var clientIp, proxyIp, clientPort, proxyPort = func() (string, string, int, int) {
-                    var err error;
-                    connectionReader = bufio.NewReader(connection);
-                    var connectionReaderBufferCount int;
-                    var connectionReaderBuffer []byte;
-
-                    // Check proxy protocol header
-                    const proxyProtocolHeaderString string = "PROXY ";
-                    const proxyProtocolHeaderStringLen int = len(proxyProtocolHeaderString);
-                    connectionReaderBuffer = make([]byte, proxyProtocolHeaderStringLen);
-                    // Read initial header
-                    connectionReaderBufferCount, err = connectionReader.Read(connectionReaderBuffer);
-                    // Check header buffer is valid, count matches expected length and buffer match expected content
-                    if(err != nil || connectionReaderBufferCount != proxyProtocolHeaderStringLen ||
-                        !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolHeaderString))) {
-                        log.Printf("Error parsing proxy protocol header prefix: %s. Error: %v", connectionReaderBuffer, err);
-                        return "", "", 0, 0;
-                    }
-
-                    // Check case of unknown proxy protocol
-                    const proxyProtocolUnknownString string = "UNKNOWN\r\n";
-                    var proxyProtocolUnknownStringLen int = len(proxyProtocolUnknownString);
-                    connectionReaderBuffer, err = connectionReader.Peek(proxyProtocolUnknownStringLen);
-                    // Check unknwon buffer is valid and data matches expected content
-                    if(err != nil || bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolUnknownString))) {
-                        log.Printf("Error parsing proxy protocol unknown: %v", err);
-                        return "", "", 0, 0;
-                    }
+                // Only accept connections from other proxies
+                if(programSettings.listenerRestrictSources && !isAllowedSource(connection.RemoteAddr(), expandHostsAddresses(orderHostsByTopology(currentHostsConfiguration.Load().(HostsConfigurationMap), "", "ordered"), hostsResolver), programSettings.listenerAllowedCidrs)) {
+                    log.Printf("Rejecting connection from %s: source not listed in the hosts configuration", connection.RemoteAddr());
+                    metrics.add("proxy_rejected_connections_total", metricsLabels("reason", "source"), 1);
+                    connection.Close();
+                    return;
+                }
 
-                    // Check TCP4 proxy protocol case
-                    // Reference: "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n"
-                    // TODO: add support to TCP6
-                    const proxyProtocolTCP4String string = "TCP4 ";
-                    const proxyProtocolTCP4StringLen int = len(proxyProtocolTCP4String);
-                    connectionReaderBuffer = make([]byte, proxyProtocolTCP4StringLen);
-                    connectionReaderBufferCount, err = connectionReader.Read(connectionReaderBuffer)
-                    // Check buffer is valid, count matches expected length and buffer matches expected content
-                    if(err != nil || connectionReaderBufferCount != proxyProtocolTCP4StringLen ||
-                        !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolTCP4String))) {
-                        log.Printf("Error parsing proxy protocol inet protocol: %s. Error: %v", connectionReaderBuffer, err);
-                        return "", "", 0, 0;
+                // Authenticate the remote proxy
+                var globalTimeouts TimeoutSettings = timeoutsForClusterPort(programSettings, 0);
+                var tlsConnection, isTls = connection.(*tls.Conn);
+                if(isTls) {
+                    tlsConnection.SetDeadline(time.Now().Add(tlsHandshakeTimeout(globalTimeouts)));
+                    var err error = tlsConnection.Handshake();
+                    if(err == nil) {
+                        err = verifyPeerIdentity(tlsConnection, expandHostsAddresses(orderHostsByTopology(currentHostsConfiguration.Load().(HostsConfigurationMap), "", "ordered"), hostsResolver));
                     }
-
-                    // Read client IP address
-                    var proxyProtocolClientIpString string;
-                    proxyProtocolClientIpString, err = connectionReader.ReadString(' ');
                     if(err != nil) {
-                        log.Printf("Error parsing proxy protocol client IP: %v", err);
-                        return "", "", 0, 0;
-                    }
-                    // Adjust string
-                    var proxyProtocolClientIpStringLen int;
-                    proxyProtocolClientIpStringLen = len(proxyProtocolClientIpString);
-                    proxyProtocolClientIpString = proxyProtocolClientIpString[:proxyProtocolClientIpStringLen-1];
-                    // Parse IP
-                    var proxyProtocolClientIp net.IP;
-                    proxyProtocolClientIp = net.ParseIP(proxyProtocolClientIpString);
-                    if(proxyProtocolClientIp == nil) {
-                        log.Printf("Error parsing client IP: %s", proxyProtocolClientIpString);
-                        return "", "", 0, 0;
+                        log.Printf("Rejecting connection from %s: %v", connection.RemoteAddr(), err);
+                        connection.Close();
+                        return;
                     }
+                }
 
-                    // Read proxy IP address
-                    var proxyProtocolProxyIpString string;
-                    proxyProtocolProxyIpString, err = connectionReader.ReadString(' ');
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol proxy IP: %v", err);
-                        return "", "", 0, 0;
-                    }
-                    // Adjust string
-                    var proxyProtocolProxyIpStringLen int;
-                    proxyProtocolProxyIpStringLen = len(proxyProtocolProxyIpString);
-                    proxyProtocolProxyIpString = proxyProtocolProxyIpString[:proxyProtocolProxyIpStringLen-1];
-                    // Parse IP
-                    var proxyProtocolProxyIp net.IP;
-                    proxyProtocolProxyIp = net.ParseIP(proxyProtocolProxyIpString);
-                    if(proxyProtocolProxyIp == nil) {
-                        log.Printf("Error parsing proxy IP: %s", proxyProtocolClientIpString);
-                        return "", "", 0, 0;
-                    }
+                // Bound the time given to the remote proxy to send its proxy protocol header
+                connection.SetDeadline(time.Time{});
+                if(globalTimeouts.proxyHeaderTimeout > 0) {
+                    connection.SetReadDeadline(time.Now().Add(globalTimeouts.proxyHeaderTimeout));
+                }
 
-                    // Read client port number
-                    var proxyProtocolClientPortString string;
-                    proxyProtocolClientPortString, err = connectionReader.ReadString(' ');
+                // Read the internal header, or the legacy proxy protocol header whose proxy port
+                // stands for the cluster port
+                var connectionReader *bufio.Reader = bufio.NewReader(connection);
+                var clientIp, proxyIp string;
+                var clientPort, proxyPort, clusterPort int;
+                var signedMessage string;
+                var headerError error;
+                var internalHeaderPrefix, _ = connectionReader.Peek(len("CP="));
+                if(string(internalHeaderPrefix) == "CP=") {
+                    var internalHeader, internalHeaderText, err = readInternalHeader(connectionReader);
                     if(err != nil) {
-                        log.Printf("Error parsing proxy protocol client port: %v", err);
-                        return "", "", 0, 0;
-                    }
-                    // Adjust number
-                    var proxyProtocolClientPortStringLen int;
-                    proxyProtocolClientPortStringLen = len(proxyProtocolClientPortString);
-                    proxyProtocolClientPortString = proxyProtocolClientPortString[:proxyProtocolClientPortStringLen-1];
-                    // Parse port
-                    var proxyProtocolClientPort int;
-                    proxyProtocolClientPort, err = strconv.Atoi(proxyProtocolClientPortString);
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol client port: %v", err);
-                        return "", "", 0, 0;
+                        log.Printf("Error parsing internal header from %s: %v", connection.RemoteAddr(), err);
+                        headerError = err;
+                    } else {
+                        clientIp, clientPort, proxyIp, proxyPort = internalHeader.clientIp, internalHeader.clientPort, internalHeader.proxyIp, internalHeader.proxyPort;
+                        clusterPort = internalHeader.clusterPort;
+                        signedMessage = internalHeaderText;
+                        if(internalHeader.proxyHeader != "") {
+                            log.Printf("Client proxy protocol header: %s", internalHeader.proxyHeader);
+                        }
                     }
+                } else {
+                    clientIp, proxyIp, clientPort, proxyPort = func() (string, string, int, int) {
+                        var err error;
+                        var connectionReaderBufferCount int;
+                        var connectionReaderBuffer []byte;
+
+                        // Check proxy protocol header
+                        const proxyProtocolHeaderString string = "PROXY ";
+                        const proxyProtocolHeaderStringLen int = len(proxyProtocolHeaderString);
+                        connectionReaderBuffer = make([]byte, proxyProtocolHeaderStringLen);
+                        // Read initial header
+                        connectionReaderBufferCount, err = io.ReadFull(connectionReader, connectionReaderBuffer);
+                        // Check header buffer is valid, count matches expected length and buffer match expected content
+                        if(err != nil || connectionReaderBufferCount != proxyProtocolHeaderStringLen ||
+                            !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolHeaderString))) {
+                            log.Printf("Error parsing proxy protocol header prefix: %s. Error: %v", connectionReaderBuffer, err);
+                            headerError = err;
+                            return "", "", 0, 0;
+                        }
 
-                    // Read proxy port number
-                    var proxyProtocolProxyPortString string;
-                    proxyProtocolProxyPortString, err = connectionReader.ReadString('\r');
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol proxy port: %v", err);
-                        return "", "", 0, 0;
-                    }
-                    // Adjust number
-                    var proxyProtocolProxyPortStringLen int;
-                    proxyProtocolProxyPortStringLen = len(proxyProtocolProxyPortString);
-                    proxyProtocolProxyPortString = proxyProtocolProxyPortString[:proxyProtocolProxyPortStringLen-1];
-                    // Parse port
-                    var proxyProtocolProxyPort int;
-                    proxyProtocolProxyPort, err = strconv.Atoi(proxyProtocolProxyPortString);
-                    if(err != nil) {
-                        log.Printf("Error parsing proxy protocol proxy port: %v", err);
-                        return "", "", 0, 0;
-                    }
+                        // Read the rest of the header line first, so that parsing never waits for, nor reads past, the header
+                        var proxyProtocolHeaderLine string;
+                        proxyProtocolHeaderLine, headerError = readHeaderLine(connectionReader, proxyProtocolMaxHeaderLength - proxyProtocolHeaderStringLen);
+                        if(headerError != nil) {
+                            log.Printf("Error reading proxy protocol header from %s: %v", connection.RemoteAddr(), headerError);
+                            return "", "", 0, 0;
+                        }
+                        var headerReader *bufio.Reader = bufio.NewReader(strings.NewReader(proxyProtocolHeaderLine));
+
+                        // Check case of unknown proxy protocol
+                        const proxyProtocolUnknownString string = "UNKNOWN\r\n";
+                        var proxyProtocolUnknownStringLen int = len(proxyProtocolUnknownString);
+                        connectionReaderBuffer, err = headerReader.Peek(proxyProtocolUnknownStringLen);
+                        // Check unknwon buffer is valid and data matches expected content
+                        if(err != nil || bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolUnknownString))) {
+                            log.Printf("Error parsing proxy protocol unknown: %v", err);
+                            return "", "", 0, 0;
+                        }
+
+                        // Check TCP4 and TCP6 proxy protocol cases
+                        // Reference: "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n"
+                        // Reference: "PROXY TCP6 ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
+                        const proxyProtocolTCP4String string = "TCP4 ";
+                        const proxyProtocolTCP6String string = "TCP6 ";
+                        const proxyProtocolInetStringLen int = len(proxyProtocolTCP4String);
+                        connectionReaderBuffer = make([]byte, proxyProtocolInetStringLen);
+                        connectionReaderBufferCount, err = io.ReadFull(headerReader, connectionReaderBuffer);
+                        // Check buffer is valid, count matches expected length and buffer matches expected content
+                        if(err != nil || connectionReaderBufferCount != proxyProtocolInetStringLen ||
+                                (!bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolTCP4String)) && !bytes.Equal(connectionReaderBuffer, []byte(proxyProtocolTCP6String)))) {
+                            log.Printf("Error parsing proxy protocol inet protocol: %s. Error: %v", connectionReaderBuffer, err);
+                            return "", "", 0, 0;
+                        }
+
+                        // Read client IP address
+                        var proxyProtocolClientIpString string;
+                        proxyProtocolClientIpString, err = headerReader.ReadString(' ');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol client IP: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust string
+                        var proxyProtocolClientIpStringLen int;
+                        proxyProtocolClientIpStringLen = len(proxyProtocolClientIpString);
+                        proxyProtocolClientIpString = proxyProtocolClientIpString[:proxyProtocolClientIpStringLen-1];
+                        // Parse IP
+                        var proxyProtocolClientIp net.IP;
+                        proxyProtocolClientIp = net.ParseIP(proxyProtocolClientIpString);
+                        if(proxyProtocolClientIp == nil) {
+                            log.Printf("Error parsing client IP: %s", proxyProtocolClientIpString);
+                            return "", "", 0, 0;
+                        }
+
+                        // Read proxy IP address
+                        var proxyProtocolProxyIpString string;
+                        proxyProtocolProxyIpString, err = headerReader.ReadString(' ');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol proxy IP: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust string
+                        var proxyProtocolProxyIpStringLen int;
+                        proxyProtocolProxyIpStringLen = len(proxyProtocolProxyIpString);
+                        proxyProtocolProxyIpString = proxyProtocolProxyIpString[:proxyProtocolProxyIpStringLen-1];
+                        // Parse IP
+                        var proxyProtocolProxyIp net.IP;
+                        proxyProtocolProxyIp = net.ParseIP(proxyProtocolProxyIpString);
+                        if(proxyProtocolProxyIp == nil) {
+                            log.Printf("Error parsing proxy IP: %s", proxyProtocolClientIpString);
+                            return "", "", 0, 0;
+                        }
+
+                        // Read client port number
+                        var proxyProtocolClientPortString string;
+                        proxyProtocolClientPortString, err = headerReader.ReadString(' ');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol client port: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust number
+                        var proxyProtocolClientPortStringLen int;
+                        proxyProtocolClientPortStringLen = len(proxyProtocolClientPortString);
+                        proxyProtocolClientPortString = proxyProtocolClientPortString[:proxyProtocolClientPortStringLen-1];
+                        // Parse port
+                        var proxyProtocolClientPort int;
+                        proxyProtocolClientPort, err = strconv.Atoi(proxyProtocolClientPortString);
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol client port: %v", err);
+                            return "", "", 0, 0;
+                        }
+
+                        // Read proxy port number
+                        var proxyProtocolProxyPortString string;
+                        proxyProtocolProxyPortString, err = headerReader.ReadString('\r');
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol proxy port: %v", err);
+                            return "", "", 0, 0;
+                        }
+                        // Adjust number
+                        var proxyProtocolProxyPortStringLen int;
+                        proxyProtocolProxyPortStringLen = len(proxyProtocolProxyPortString);
+                        proxyProtocolProxyPortString = proxyProtocolProxyPortString[:proxyProtocolProxyPortStringLen-1];
+                        // Parse port
+                        var proxyProtocolProxyPort int;
+                        proxyProtocolProxyPort, err = strconv.Atoi(proxyProtocolProxyPortString);
+                        if(err != nil) {
+                            log.Printf("Error parsing proxy protocol proxy port: %v", err);
+                            return "", "", 0, 0;
+                        }
+
+                        // Read trailing characters
+                        var proxyProtocolTrailingByte byte;
+                        proxyProtocolTrailingByte, err = headerReader.ReadByte();
+                        if(err != nil || proxyProtocolTrailingByte != '\n') {
+                            log.Printf("Error parsing proxy protocol trailing byte: %v", err);
+                            return "", "", 0, 0;
+                        }
+
+                        return proxyProtocolClientIpString, proxyProtocolProxyIpString, proxyProtocolClientPort, proxyProtocolProxyPort;
+                    } ();
+                    clusterPort = proxyPort;
+                    signedMessage = handshakeMessage(clientIp, proxyIp, clientPort, proxyPort);
+                }
 
-                    // Read trailing characters
-                    var proxyProtocolTrailingByte byte;
-                    proxyProtocolTrailingByte, err = connectionReader.ReadByte();
-                    if(err != nil || proxyProtocolTrailingByte != '\n') {
-                        log.Printf("Error parsing proxy protocol trailing byte: %v", err);
-                        return "", "", 0, 0;
+                // Check the remote proxy knows the cluster secret
+                if(authenticator != nil && clusterPort != 0) {
+                    var err error = authenticator.verify(connectionReader, connection.LocalAddr().String(), signedMessage);
+                    if(err != nil) {
+                        log.Printf("Rejecting handshake from %s: %v", connection.RemoteAddr(), err);
+                        metrics.add("proxy_rejected_connections_total", metricsLabels("reason", "auth"), 1);
+                        io.WriteString(connection, responseMappingInactive);
+                        connection.Close();
+                        return;
                     }
+                }
 
-                    return proxyProtocolClientIpString, proxyProtocolProxyIpString, proxyProtocolClientPort, proxyProtocolProxyPort;
-                } ();
+                // Check the client again, in case the remote proxy runs with other rules
+                if(clusterPort != 0 && !isClientAllowed(accessControl.Load().(AccessControlMap), clusterPort, clientIp)) {
+                    log.Printf("Rejecting connection from %s: client %s not allowed on cluster port %d", connection.RemoteAddr(), clientIp, clusterPort);
+                    metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(clusterPort), "reason", "access"), 1);
+                    io.WriteString(connection, responseMappingInactive);
+                    connection.Close();
+                    return;
+                }
+                connection.SetReadDeadline(time.Time{});
 
                 // Reply port mapping status
-                const responseMappingActive string = "go ahead\n"
-                const responseMappingInactive string = "go away\n"
-                log.Printf("Reading back proxy protocol line. inet: tcp | Remote clientip: %s, clientport %d | Proxy proxyip: %s, proxyport: %d\n", clientIp, clientPort, proxyIp, proxyPort);
-                if(proxyPort == 0) {
-                    log.Printf("Error reading back from proxy protocol line. Proxy port: %d", proxyPort);
+                log.Printf("Reading back proxy protocol line. inet: tcp | Remote clientip: %s, clientport %d | Proxy proxyip: %s, proxyport: %d | Cluster port: %d\n", clientIp, clientPort, proxyIp, proxyPort, clusterPort);
+                if(clusterPort == 0) {
+                    log.Printf("Error reading back from proxy protocol line. Cluster port: %d", clusterPort);
+                    metrics.add("proxy_rejected_connections_total", metricsLabels("reason", headerErrorReason(headerError)), 1);
                     err = connection.Close();
                     if(err != nil) {
                         log.Printf("Error closing connection: %s. Error: %v", connection.RemoteAddr(), err);
                     }
                     return;
                 } else {
-                    if(newPortsConfiguration[proxyPort] != nil) {
-
-                        var hostPorts []PortsConfigurationData;
-                        hostPorts = newPortsConfiguration[proxyPort];
+                    var hostPorts []PortsConfigurationData;
+                    hostPorts = currentPortsConfiguration.Load().(PortsConfigurationMap)[clusterPort];
+                    if(hostPorts != nil) {
 
                         // Pass the connection to handler
                         if(connection != nil) {
                             go func(mode string, address string, ports []PortsConfigurationData, conn net.Conn) {
                                 var hostConnection net.Conn;
                                 var err error;
+                                var timeouts TimeoutSettings = timeoutsForClusterPort(programSettings, clusterPort);
+
+                                // Keep a single client from using up the host ports connections
+                                var limitReason string = clientLimiter.acquire(clusterPort, clientIp, clientLimitsForClusterPort(programSettings, clusterPort));
+                                if(limitReason != "") {
+                                    log.Printf("Rejecting connection from client %s on cluster port %d: %s", clientIp, clusterPort, limitReason);
+                                    metrics.add("proxy_rejected_connections_total", metricsLabels("clusterPort", strconv.Itoa(clusterPort), "reason", limitReason), 1);
+                                    io.WriteString(connection, responseMappingRejectedPrefix + limitReason + "\n");
+                                    connection.Close();
+                                    return;
+                                }
+                                defer clientLimiter.release(clusterPort, clientIp);
+
+                                // Iterate over all host ports trying to connect to host,
+                                // in the order given by the cluster port load balancing strategy
+                                var portsData PortsConfigurationData;
+                                var strategy string = hostPortsStrategy(ports);
+
+                                // Copy client data to mirror host ports once per client connection, whatever host ports are tried,
+                                // so that mirrors only ever see live client data
+                                var clientSource io.Reader = connectionReader;
+                                var mirrors []*MirrorWriter;
+                                var mirrorWriters []io.Writer;
+                                var mirrorPortsData PortsConfigurationData;
+                                for _, mirrorPortsData = range ports {
+                                    if(!mirrorPortsData.mirror) {
+                                        continue;
+                                    }
+                                    var mirrorLabels string = metricsLabels("clusterPort", strconv.Itoa(clusterPort), "hostPort", strconv.Itoa(mirrorPortsData.hostPort), "pod", mirrorPortsData.podId);
+                                    var mirrorHost string = address + ":" + strconv.Itoa(mirrorPortsData.hostPort);
+                                    var mirror *MirrorWriter = startMirror(mode, mirrorHost, mirrorPortsData, timeouts.dialTimeout, mirrorBufferSize, clientIp, proxyIp, clientPort, proxyPort, func() {
+                                        metrics.add("proxy_mirror_dropped_total", mirrorLabels, 1);
+                                    });
+                                    mirrors = append(mirrors, mirror);
+                                    mirrorWriters = append(mirrorWriters, mirror);
+                                    metrics.add("proxy_mirror_connections_total", mirrorLabels, 1);
+                                }
+                                if(len(mirrorWriters) > 0) {
+                                    clientSource = io.TeeReader(connectionReader, io.MultiWriter(mirrorWriters...));
+                                }
+                                defer func() {
+                                    var mirror *MirrorWriter;
+                                    for _, mirror = range mirrors {
+                                        stopMirror(mirror);
+                                    }
+                                } ();
 
-                                // Iterate over all host ports trying to connect to host
-                                var hostPortsIndex int;
-                                var hostPortsLen = len(ports);
-                                var attempts int = 0;
-                                log.Printf("Current number of configured host ports: %d", hostPortsLen);
-                                for hostPortsIndex=0; hostPortsIndex < hostPortsLen; hostPortsIndex++ {
-                                    var currentHostPort = ports[hostPortsIndex].hostPort;
+                                // Keep a copy of client data, to replay it to the next host port should a host port hang up before replying
+                                var replay *ReplayBuffer;
+                                if(retryOnEarlyClose) {
+                                    replay = &ReplayBuffer{reader: clientSource, maxSize: replayBufferSize};
+                                }
+                                var committed bool = false;
+                                log.Printf("Current number of configured host ports: %d (strategy: %s)", len(ports), strategy);
+                                for _, portsData = range hostPortsOutlierDetector.orderHostPorts(hostPortsBalancer.order(clusterPort, strategy, ports)) {
+                                    var currentHostPort = portsData.hostPort;
                                     var host = address + ":" + strconv.Itoa(currentHostPort);
+                                    if(connectionRegistry.isDrained(portsData.podId)) {
+                                        log.Printf("Skipping %s: pod %s is drained", host, portsData.podId);
+                                        continue;
+                                    }
+                                    if(!healthChecker.isHealthy(currentHostPort)) {
+                                        log.Printf("Skipping %s: failing health checks", host);
+                                        continue;
+                                    }
+                                    if(portsData.backup) {
+                                        log.Printf("No primary host port available, trying backup %s", host);
+                                    }
 
                                     // Limit max connections
-                                    var currentHostMaxConnections = ports[hostPortsIndex].maxConnections;
-                                    if(currentHostPortsMaxConnections[currentHostPort] >= currentHostMaxConnections) {
+                                    var currentHostMaxConnections = portsData.maxConnections;
+                                    if(!hostPortsBalancer.acquire(currentHostPort, currentHostMaxConnections)) {
                                         log.Printf("Error connecting to %s in mode %s. Reached maximum number of active connections (%d)", host, mode, currentHostMaxConnections);
-                                        if(hostPortsIndex == (hostPortsLen-1)) {
-                                            fmt.Fprintf(connection, responseMappingInactive);
-                                            log.Printf("Closing connection: %s", connection.RemoteAddr());
-                                            err = connection.Close();
-                                            if(err != nil) {
-                                                log.Printf("Error closing connection: %s. Error: %v", connection.RemoteAddr(), err);
-                                            }
+                                        continue;
+                                    }
+
+                                    var dialTimeout time.Duration = timeouts.dialTimeout;
+                                    if(portsData.connectTimeout > 0) {
+                                        dialTimeout = portsData.connectTimeout;
+                                    }
+                                    hostConnection, err = net.DialTimeout(mode, host, dialTimeout);
+                                    if(err != nil) {
+                                        hostPortsBalancer.release(currentHostPort);
+                                        log.Printf("Error connecting to %s in mode %s. Message: %v", host, mode, err);
+                                        if(hostPortsOutlierDetector.recordFailure(strconv.Itoa(currentHostPort))) {
+                                            metrics.add("proxy_outlier_ejections_total", metricsLabels("clusterPort", strconv.Itoa(clusterPort), "hostPort", strconv.Itoa(currentHostPort), "pod", portsData.podId), 1);
+                                        }
+                                        continue;
+                                    }
+
+                                    if(!committed) {
+                                        if(timeouts.handshakeTimeout > 0) {
+                                            connection.SetWriteDeadline(time.Now().Add(timeouts.handshakeTimeout));
+                                        }
+                                        _, err = io.WriteString(connection, responseMappingActive);
+                                        connection.SetWriteDeadline(time.Time{});
+                                        if(err != nil) {
+                                            log.Printf("Error replying mapping status to %s: %v", connection.RemoteAddr(), err);
+                                            hostPortsBalancer.release(currentHostPort);
+                                            hostConnection.Close();
+                                            connection.Close();
                                             return;
-                                        } else {
-                                            attempts++;
-                                            continue;
                                         }
+                                        committed = true;
+                                    }
+                                    log.Printf("Connected to %s", host);
+
+                                    var currentSendProxyFlag = portsData.sendProxyFlag;
+                                    if(currentSendProxyFlag) {
+                                        err = writeProxyHeader(hostConnection, portsData.proxyVersion, clientIp, proxyIp, clientPort, proxyPort);
+                                        if(err != nil) {
+                                            log.Printf("Error sending proxy protocol header to %s: %v", host, err);
+                                        }
+                                        log.Printf("sendProxy is set (v%d)", portsData.proxyVersion);
                                     }
 
-                                    hostConnection, err = net.Dial(mode, host);
-                                    if(err == nil) {
-                                        fmt.Fprintf(connection, responseMappingActive);
-                                        log.Printf("Connected to %s", host);
+                                    log.Printf("Current connections on port %d: %d (%d)", currentHostPort, hostPortsBalancer.activeConnections(currentHostPort), currentHostMaxConnections);
+
+                                    // Proxy traffic until either side hangs up
+                                    var client string = net.JoinHostPort(clientIp, strconv.Itoa(clientPort));
+                                    var labels string = metricsLabels("clusterPort", strconv.Itoa(clusterPort), "hostPort", strconv.Itoa(currentHostPort), "pod", portsData.podId);
+                                    var connectionId int64 = connectionRegistry.register(&ConnectionInfo{
+                                        clusterPort: clusterPort,
+                                        hostPort: currentHostPort,
+                                        podId: portsData.podId,
+                                        client: client,
+                                        startTime: time.Now(),
+                                        clientConnection: conn,
+                                        hostConnection: hostConnection,
+                                    });
+                                    metrics.add("proxy_connections_total", labels, 1);
+                                    metrics.add("proxy_active_connections", labels, 1);
+
+                                    // Expose the traffic split of the cluster port
+                                    var expectedShares, achievedShares = hostPortsBalancer.recordRouted(clusterPort, currentHostPort, ports);
+                                    var splitPortsData PortsConfigurationData;
+                                    for _, splitPortsData = range ports {
+                                        var splitLabels string = metricsLabels("clusterPort", strconv.Itoa(clusterPort), "hostPort", strconv.Itoa(splitPortsData.hostPort), "pod", splitPortsData.podId);
+                                        metrics.setRatio("proxy_split_expected_ratio", splitLabels, expectedShares[splitPortsData.hostPort]);
+                                        metrics.setRatio("proxy_split_achieved_ratio", splitLabels, achievedShares[splitPortsData.hostPort]);
+                                    }
+                                    var startTime time.Time = time.Now();
+                                    log.Printf("Copying to hostConnection %s and conn %s", hostConnection.RemoteAddr(), conn.RemoteAddr());
+                                    var clientReader io.Reader = clientSource;
+                                    if(replay != nil) {
+                                        clientReader = replay;
+                                    }
 
-                                        var currentSendProxyFlag = ports[hostPortsIndex].sendProxyFlag;
-                                        if(currentSendProxyFlag) {
-                                            var proxyLine = "PROXY TCP4 " + clientIp + " " + proxyIp + " " + strconv.Itoa(clientPort) + " " + strconv.Itoa(proxyPort) + "\r\n";
-                                            fmt.Fprintf(hostConnection, proxyLine);
-                                            log.Printf("sendProxy is set");
+                                    // Replay client data already sent to previous host ports. Mirrors got it already
+                                    if(replay != nil && len(replay.data) > 0) {
+                                        _, err = hostConnection.Write(replay.data);
+                                        if(err != nil) {
+                                            log.Printf("Error replaying client data to %s: %v", host, err);
                                         }
+                                    }
 
-                                        currentHostPortsMaxConnections[currentHostPort]++; // TODO: FIXME: CMPXCHG
-                                        log.Printf("Current connections on port %d: %d (%d)", currentHostPort, currentHostPortsMaxConnections[currentHostPort], currentHostMaxConnections);
-                                        var isConnected = true; // TODO: FIXME: atomic
-
-                                        // Input: Send data from received connection to host
-                                        go func() {
-                                            defer func() {
-                                                log.Printf("Closing input host connection...");
-                                                if(isConnected) { // TODO: FIXME: atomic
-                                                    currentHostPortsMaxConnections[currentHostPort]--;
-                                                    isConnected = false;
-                                                }
-                                            } ();
-
-                                            var err error;
-                                            _, err = io.Copy(conn, hostConnection);
-                                            if(err != nil) {
-                                                log.Printf("Error copying data from cluster to host: %v", err);
-                                                hostConnection.Close();
-                                                return;
-                                            }
-                                        }();
-
-                                        // Output: send data from host back to the original connection
-                                        go func() {
-                                            defer func() {
-                                                log.Printf("Closing output host connection...");
-                                                if(isConnected) { // TODO: FIXME: atomic
-                                                    currentHostPortsMaxConnections[currentHostPort]--;
-                                                    isConnected = false;
-                                                }
-                                            } ();
-
-                                            var err error;
-                                            log.Printf("Copying to hostConnection %s and conn %s", hostConnection.RemoteAddr(), conn.RemoteAddr());
-                                            _, err = io.Copy(hostConnection, connectionReader);
-                                            if(err != nil) {
-                                                log.Printf("Error copying data from host to cluster: %v", err);
-                                                hostConnection.Close();
-                                                return;
-                                            }
-                                        }();
-
-                                        // End host ports loop
-                                        break;
-                                    } else {
-                                        attempts++;
-                                        log.Printf("Error connecting to %s in mode %s. Message: %v", host, mode, err);
-                                        if(attempts >= hostPortsLen) {
-                                            fmt.Fprintf(connection, responseMappingInactive);
-                                            log.Printf("Closing connection: %s", connection.RemoteAddr());
-                                            err = connection.Close();
-                                            if(err != nil) {
-                                                log.Printf("Error closing connection: %s. Error: %v", connection.RemoteAddr(), err);
-                                            }
-                                            return;
+                                    // Throttle both directions to the bandwidth limits of the host port.
+                                    // Limits are looked up on every read, so reloads apply to active connections too.
+                                    clientReader = &ThrottledReader{clientReader, bandwidthLimiters.get(bandwidthKey("hostPort", currentHostPort, "in"))};
+                                    var hostReader io.Reader = &ThrottledReader{hostConnection, bandwidthLimiters.get(bandwidthKey("hostPort", currentHostPort, "out"))};
+                                    var result ForwardResult = forwardConnections(conn, clientReader, hostConnection, hostReader, timeouts, replay);
+                                    if(result.hostClosedEarly) {
+                                        log.Printf("Host port %d closed connection %s before replying", currentHostPort, client);
+                                        if(hostPortsOutlierDetector.recordFailure(strconv.Itoa(currentHostPort))) {
+                                            metrics.add("proxy_outlier_ejections_total", labels, 1);
                                         }
+                                    } else {
+                                        hostPortsOutlierDetector.recordSuccess(strconv.Itoa(currentHostPort));
+                                    }
+                                    log.Printf("Closed host connection %s", host);
+                                    connectionRegistry.unregister(connectionId);
+                                    metrics.add("proxy_active_connections", labels, -1);
+                                    metrics.add("proxy_received_bytes_total", labels, result.bytesToHost);
+                                    metrics.add("proxy_sent_bytes_total", labels, result.bytesToClient);
+                                    hostPortsBalancer.release(currentHostPort);
+                                    log.Printf("[access] client=%s clusterPort=%d hostPort=%d pod=%s received=%d sent=%d duration=%v", client, clusterPort, currentHostPort, portsData.podId, result.bytesToHost, result.bytesToClient, time.Since(startTime));
+                                    if(result.retry) {
+                                        log.Printf("Retrying connection %s on the next host port", client);
+                                        metrics.add("proxy_early_close_retries_total", labels, 1);
+                                        continue;
                                     }
+                                    return;
+                                }
+
+                                // No host port could take the connection
+                                if(!committed) {
+                                    io.WriteString(connection, responseMappingInactive);
+                                }
+                                log.Printf("Closing connection: %s", connection.RemoteAddr());
+                                err = connection.Close();
+                                if(err != nil) {
+                                    log.Printf("Error closing connection: %s. Error: %v", connection.RemoteAddr(), err);
                                 }
                             } (networkMode, hostAddress, hostPorts, connection);
                         } else {
@@ -1399,7 +4899,7 @@ func main() {
                             return;
                         }
                     } else {
-                        fmt.Fprintf(connection, responseMappingInactive);
+                        io.WriteString(connection, responseMappingInactive);
                         log.Printf("Closing connection: %s", connection.RemoteAddr());
                         err = connection.Close();
                         if(err != nil) {
@@ -1412,6 +4912,65 @@ func main() {
         }
     } (listener);
 
+    // Check host ports health
+    go healthChecker.run(networkMode, hostAddress, func() (PortsConfigurationMap) {
+        return currentPortsConfiguration.Load().(PortsConfigurationMap);
+    });
+
+    // Serve admin commands. Commands can kill connections, so listening beyond the
+    // loopback interface requires an admin token
+    if(programSettings.adminListenerPort > 0) {
+        var adminToken []byte;
+        if(programSettings.adminTokenFile != "") {
+            token, err := ioutil.ReadFile(programSettings.adminTokenFile);
+            if(err != nil || len(bytes.TrimSpace(token)) == 0) {
+                log.Printf("Error reading admin token file %s: %v", programSettings.adminTokenFile, err);
+                os.Exit(1);
+            }
+            adminToken = bytes.TrimSpace(token);
+        }
+        if(!isLoopbackHost(programSettings.adminListenerHost) && adminToken == nil) {
+            log.Printf("Error listening to admin host \"%s\": non-loopback admin listeners require adminTokenFile", programSettings.adminListenerHost);
+            os.Exit(1);
+        }
+        var adminListener net.Listener = func(mode string, address string) (net.Listener) {
+            listen, err := net.Listen(mode, address);
+            if(err != nil) {
+                log.Printf("Error listening to %s in mode %s: %v", address, mode, err);
+                os.Exit(1);
+            }
+            log.Printf("Listening to %s (admin)", address);
+            return listen;
+        } (networkMode, net.JoinHostPort(programSettings.adminListenerHost, strconv.Itoa(programSettings.adminListenerPort)));
+        go func(listener net.Listener) {
+            for {
+                var connection net.Conn;
+                var err error;
+                connection, err = listener.Accept();
+                if(err != nil) {
+                    log.Printf("[admin] Error accepting connection: %v", err);
+                    return;
+                }
+                go handleAdminConnection(connection, connectionRegistry, metrics, func() (PortsConfigurationMap) {
+                    return currentPortsConfiguration.Load().(PortsConfigurationMap);
+                }, adminToken);
+            }
+        } (adminListener);
+    }
+
+    // Reload TLS files on changes
+    if(certificateStore != nil) {
+        go func() {
+            for {
+                time.Sleep(5 * time.Second);
+                var err error = certificateStore.load();
+                if(err != nil) {
+                    log.Printf("Error reloading TLS files: %v. Keeping previous ones", err);
+                }
+            }
+        } ();
+    }
+
     // Install watcher for ports configuration file changes
     var watchForFileChanges = func(filePath string, channel chan bool) {
         var fileStatBase os.FileInfo;
@@ -1459,11 +5018,13 @@ func main() {
             fileHasChanged = <-watchChannel;
             if(fileHasChanged) {
                 log.Printf("Ports configuration file has changed: %s. Reloading...\n", portsConfigurationFile);
-                var configuration = loadPortsConfiguration(portsConfigurationFile);
+                var configuration, clusterPortsOptions = loadPortsConfiguration(portsConfigurationFile);
                 if(configuration != nil) {
-                    log.Printf("Ports configuration: %v\n", newPortsConfiguration);
+                    log.Printf("Ports configuration: %v\n", configuration);
                     // TODO: FIXME: newPortsConfiguration should drop all connections that were removed in the reload process (diff)
-                    newPortsConfiguration = configuration;
+                    hostPortsBalancer.track(configuration, false);
+                    bandwidthLimiters.update(configuration, clusterPortsOptions);
+                    currentPortsConfiguration.Store(configuration);
                 }
             }
         }
@@ -1480,11 +5041,43 @@ func main() {
                 log.Printf("Hosts configuration file has changed: %s. Reloading...\n", hostsConfigurationFile);
                 var configuration = loadHostsConfiguration(hostsConfigurationFile);
                 if(configuration != nil) {
-                    log.Printf("Hosts configuration: %v\n", hostsConfiguration);
+                    log.Printf("Hosts configuration: %v\n", configuration);
                     // TODO: FIXME: hostsConfiguration should drop all connections that were removed in the reload process (diff)
-                    hostsConfiguration = configuration;
+                    hostsResolver.refresh(configuration);
+                    currentHostsConfiguration.Store(configuration);
+                }
+            }
+        }
+    } ();
+
+    if(programSettings.accessControlFile != "") {
+        var watchChannelAccess chan bool;
+        go func() {
+            var fileHasChanged bool;
+            for {
+                watchChannelAccess = make(chan bool);
+                go watchForFileChanges(programSettings.accessControlFile, watchChannelAccess);
+                fileHasChanged = <-watchChannelAccess;
+                if(fileHasChanged) {
+                    log.Printf("Access control file has changed: %s. Reloading...\n", programSettings.accessControlFile);
+                    var configuration, err = loadAccessControl(programSettings.accessControlFile);
+                    if(err != nil) {
+                        log.Printf("Error reading access control file %s: %v. Keeping previous rules", programSettings.accessControlFile, err);
+                    } else {
+                        accessControl.Store(configuration);
+                    }
+                } else {
+                    time.Sleep(2 * time.Second);
                 }
             }
+        } ();
+    }
+
+    // Periodically re-resolve host names
+    go func() {
+        for {
+            time.Sleep(hostsResolveInterval);
+            hostsResolver.refresh(currentHostsConfiguration.Load().(HostsConfigurationMap));
         }
     } ();
 
@@ -0,0 +1,848 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTestBalancer() (*HostPortsBalancer) {
+    return &HostPortsBalancer{
+        activeConnectionsCount: make(map[int]int),
+        roundRobinIndex: make(map[int]int),
+        routedConnections: make(map[int]map[int]int64),
+        firstSeen: make(map[int]time.Time),
+    };
+}
+
+func hostPortsOf(ports []PortsConfigurationData) ([]int) {
+    var hostPorts []int;
+    var portsData PortsConfigurationData;
+    for _, portsData = range ports {
+        hostPorts = append(hostPorts, portsData.hostPort);
+    }
+    return hostPorts;
+}
+
+func equalInts(a []int, b []int) (bool) {
+    if(len(a) != len(b)) {
+        return false;
+    }
+    var index int;
+    for index = range a {
+        if(a[index] != b[index]) {
+            return false;
+        }
+    }
+    return true;
+}
+
+/*============================
+ TestOrderBackups
+
+ Backup host ports come after every primary host port, whatever the strategy, and
+ mirror host ports are never routed to.
+============================*/
+func TestOrderBackups(t *testing.T) {
+    var ports []PortsConfigurationData = []PortsConfigurationData{
+        {hostPort: 31001, maxConnections: 10, backup: true},
+        {hostPort: 31002, maxConnections: 10},
+        {hostPort: 31003, maxConnections: 10, mirror: true},
+        {hostPort: 31004, maxConnections: 10, backup: true},
+        {hostPort: 31005, maxConnections: 10},
+    };
+    var tests = []struct {
+        strategy string;
+        primaries []int;
+        backups []int;
+    }{
+        {"sequential", []int{31002, 31005}, []int{31001, 31004}},
+        {"roundrobin", nil, nil},
+        {"leastconn", nil, nil},
+        {"random", nil, nil},
+        {"weighted", nil, nil},
+    };
+    for _, test := range tests {
+        var balancer *HostPortsBalancer = newTestBalancer();
+        var iteration int;
+        for iteration = 0; iteration < 20; iteration++ {
+            var ordered []int = hostPortsOf(balancer.order(29999, test.strategy, ports));
+            if(len(ordered) != 4) {
+                t.Fatalf("%s: got %v, expected 4 host ports without the mirror", test.strategy, ordered);
+            }
+            var primary int;
+            for _, primary = range ordered[:2] {
+                if(primary != 31002 && primary != 31005) {
+                    t.Fatalf("%s: got %v, expected primaries first", test.strategy, ordered);
+                }
+            }
+            if(test.primaries != nil && (!equalInts(ordered[:2], test.primaries) || !equalInts(ordered[2:], test.backups))) {
+                t.Fatalf("%s: got %v, expected %v then %v", test.strategy, ordered, test.primaries, test.backups);
+            }
+        }
+    }
+}
+
+/*============================
+ TestOrderEntriesRoundRobin
+
+ Primaries and backups keep round robin positions of their own.
+============================*/
+func TestOrderEntriesRoundRobin(t *testing.T) {
+    var balancer *HostPortsBalancer = newTestBalancer();
+    var ports []PortsConfigurationData = []PortsConfigurationData{
+        {hostPort: 31001, maxConnections: 10},
+        {hostPort: 31002, maxConnections: 10},
+        {hostPort: 31003, maxConnections: 10, backup: true},
+        {hostPort: 31004, maxConnections: 10, backup: true},
+    };
+    var expected [][]int = [][]int{
+        {31001, 31002, 31003, 31004},
+        {31002, 31001, 31004, 31003},
+        {31001, 31002, 31003, 31004},
+    };
+    var order []int;
+    for _, order = range expected {
+        var ordered []int = hostPortsOf(balancer.order(29999, "roundrobin", ports));
+        if(!equalInts(ordered, order)) {
+            t.Fatalf("got %v, expected %v", ordered, order);
+        }
+    }
+}
+
+/*============================
+ TestOrderEntriesWeighted
+
+ The weighted strategy picks a host port first in proportion to its weight, which
+ defaults to maxConnections. Host ports without any weight come last.
+============================*/
+func TestOrderEntriesWeighted(t *testing.T) {
+    var tests = []struct {
+        name string;
+        ports []PortsConfigurationData;
+        shares map[int]float64;
+        last int;
+    }{
+        {
+            "explicit weights",
+            []PortsConfigurationData{{hostPort: 31001, maxConnections: 10, weight: 3}, {hostPort: 31002, maxConnections: 10, weight: 1}},
+            map[int]float64{31001: 0.75, 31002: 0.25},
+            0,
+        },
+        {
+            "maxConnections as weight",
+            []PortsConfigurationData{{hostPort: 31001, maxConnections: 1}, {hostPort: 31002, maxConnections: 4}},
+            map[int]float64{31001: 0.2, 31002: 0.8},
+            0,
+        },
+        {
+            "zero weight last",
+            []PortsConfigurationData{{hostPort: 31001}, {hostPort: 31002, maxConnections: 1}, {hostPort: 31003, maxConnections: 1}},
+            map[int]float64{31001: 0, 31002: 0.5, 31003: 0.5},
+            31001,
+        },
+    };
+    const iterations int = 10000;
+    for _, test := range tests {
+        var balancer *HostPortsBalancer = newTestBalancer();
+        var firsts map[int]int = make(map[int]int);
+        var iteration int;
+        for iteration = 0; iteration < iterations; iteration++ {
+            var ordered []int = hostPortsOf(balancer.orderEntries(29999, "weighted", test.ports));
+            if(len(ordered) != len(test.ports)) {
+                t.Fatalf("%s: got %v, expected every host port once", test.name, ordered);
+            }
+            if(test.last != 0 && ordered[len(ordered) - 1] != test.last) {
+                t.Fatalf("%s: got %v, expected %d last", test.name, ordered, test.last);
+            }
+            firsts[ordered[0]]++;
+        }
+        var hostPort int;
+        var share float64;
+        for hostPort, share = range test.shares {
+            var got float64 = float64(firsts[hostPort]) / float64(iterations);
+            if(got < share - 0.05 || got > share + 0.05) {
+                t.Errorf("%s: host port %d first %.2f of the time, expected %.2f", test.name, hostPort, got, share);
+            }
+        }
+    }
+}
+
+/*============================
+ TestWriteProxyHeader
+
+ Version 1 headers are text lines, version 2 headers are binary, with the address
+ block length matching the address family.
+============================*/
+func TestWriteProxyHeader(t *testing.T) {
+    // Version 2 header of a TCP connection from port 56324 to port 443
+    var v2Header = func(family byte, clientIp net.IP, proxyIp net.IP) ([]byte) {
+        var header []byte = []byte("\r\n\r\n\x00\r\nQUIT\n");
+        var length int = len(clientIp) + len(proxyIp) + 4;
+        header = append(header, 0x21, family, byte(length >> 8), byte(length));
+        header = append(append(header, clientIp...), proxyIp...);
+        return append(header, 0xdc, 0x04, 0x01, 0xbb);
+    };
+    var tests = []struct {
+        name string;
+        version int;
+        clientIp string;
+        proxyIp string;
+        expected []byte;
+    }{
+        {"v1 TCP4", 1, "192.168.0.1", "192.168.0.11", []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")},
+        {"v1 TCP6", 1, "fd00::1", "fd00::2", []byte("PROXY TCP6 fd00::1 fd00::2 56324 443\r\n")},
+        {"v1 UNKNOWN", 1, "unknown", "192.168.0.11", []byte("PROXY UNKNOWN\r\n")},
+        {"v2 TCP4", 2, "192.168.0.1", "192.168.0.11", v2Header(0x11, net.IP{192, 168, 0, 1}, net.IP{192, 168, 0, 11})},
+        {"v2 TCP6", 2, "fd00::1", "fd00::2", v2Header(0x21, net.ParseIP("fd00::1"), net.ParseIP("fd00::2"))},
+        {"v2 mixed families", 2, "192.168.0.1", "fd00::2", v2Header(0x21, net.ParseIP("192.168.0.1").To16(), net.ParseIP("fd00::2"))},
+        {"v2 LOCAL", 2, "unknown", "192.168.0.11", []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")},
+    };
+    for _, test := range tests {
+        var header bytes.Buffer;
+        var err error = writeProxyHeader(&header, test.version, test.clientIp, test.proxyIp, 56324, 443);
+        if(err != nil) {
+            t.Fatalf("%s: %v", test.name, err);
+        }
+        if(!bytes.Equal(header.Bytes(), test.expected)) {
+            t.Errorf("%s: got %q, expected %q", test.name, header.Bytes(), test.expected);
+        }
+    }
+}
+
+/*============================
+ TestLoadPortsConfigurationOptions
+
+ Valid options are applied, invalid values are errors, and unknown or malformed
+ options are skipped.
+============================*/
+func TestLoadPortsConfigurationOptions(t *testing.T) {
+    var tests = []struct {
+        options []string;
+        expected PortsConfigurationData;
+        fails bool;
+    }{
+        {[]string{"weight=3"}, PortsConfigurationData{weight: 3}, false},
+        {[]string{"weight=0"}, PortsConfigurationData{}, true},
+        {[]string{"weight=-1"}, PortsConfigurationData{}, true},
+        {[]string{"weight=heavy"}, PortsConfigurationData{}, true},
+        {[]string{"proxy=v1"}, PortsConfigurationData{proxyVersion: 1}, false},
+        {[]string{"proxy=v2"}, PortsConfigurationData{proxyVersion: 2}, false},
+        {[]string{"proxy=v3"}, PortsConfigurationData{}, true},
+        {[]string{"timeout=250ms"}, PortsConfigurationData{connectTimeout: 250 * time.Millisecond}, false},
+        {[]string{"timeout=-1s"}, PortsConfigurationData{}, true},
+        {[]string{"backup=true", "mirror=false"}, PortsConfigurationData{backup: true}, false},
+        {[]string{"backup=maybe"}, PortsConfigurationData{}, true},
+        {[]string{"check=http", "checkPath=/health", "checkInterval=2s", "checkTimeout=500ms"}, PortsConfigurationData{check: "http", checkPath: "/health", checkInterval: 2 * time.Second, checkTimeout: 500 * time.Millisecond}, false},
+        {[]string{"check=udp"}, PortsConfigurationData{}, true},
+        {[]string{"checkInterval=0s"}, PortsConfigurationData{}, true},
+        {[]string{"slowStart=30s"}, PortsConfigurationData{slowStart: 30 * time.Second}, false},
+        {[]string{"rateIn=1000", "rateOut=2000"}, PortsConfigurationData{rateIn: 1000, rateOut: 2000}, false},
+        {[]string{"rateIn=-1"}, PortsConfigurationData{}, true},
+        {[]string{"id=pod-a", "strategy=leastconn"}, PortsConfigurationData{podId: "pod-a", strategy: "leastconn"}, false},
+        {[]string{"strategy=fastest"}, PortsConfigurationData{}, true},
+        {[]string{"", "color=blue", "weight"}, PortsConfigurationData{}, false},
+    };
+    for _, test := range tests {
+        var portsData PortsConfigurationData;
+        var err error = loadPortsConfigurationOptions(&portsData, test.options);
+        if(test.fails) {
+            if(err == nil) {
+                t.Errorf("%v: expected an error", test.options);
+            }
+            continue;
+        }
+        if(err != nil) {
+            t.Errorf("%v: %v", test.options, err);
+        } else if(portsData != test.expected) {
+            t.Errorf("%v: got %+v, expected %+v", test.options, portsData, test.expected);
+        }
+    }
+}
+
+func newTestOutlierDetector(consecutiveFailures int) (*OutlierDetector) {
+    return &OutlierDetector{
+        consecutiveFailures: consecutiveFailures,
+        baseEjectionTime: 1 * time.Second,
+        maxEjectionTime: 3 * time.Second,
+        failures: make(map[string]int),
+        ejections: make(map[string]int),
+        ejectedUntil: make(map[string]time.Time),
+    };
+}
+
+/*============================
+ TestOutlierDetectorBackoff
+
+ An endpoint is ejected after the configured number of consecutive failures, for
+ twice as long at every consecutive ejection, up to the maximum ejection time.
+============================*/
+func TestOutlierDetectorBackoff(t *testing.T) {
+    var detector *OutlierDetector = newTestOutlierDetector(2);
+    var expected []time.Duration = []time.Duration{1 * time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second};
+    var ejectionTime time.Duration;
+    for _, ejectionTime = range expected {
+        if(detector.recordFailure("10.0.0.1:32767")) {
+            t.Fatalf("ejected after a single failure");
+        }
+        if(!detector.recordFailure("10.0.0.1:32767")) {
+            t.Fatalf("not ejected after two consecutive failures");
+        }
+        if(!detector.isEjected("10.0.0.1:32767") || detector.isEjected("10.0.0.2:32767")) {
+            t.Fatalf("expected only the failing endpoint to be ejected");
+        }
+        var remaining time.Duration = time.Until(detector.ejectedUntil["10.0.0.1:32767"]);
+        if(remaining > ejectionTime || remaining < ejectionTime - 100 * time.Millisecond) {
+            t.Fatalf("ejected for %v, expected %v", remaining, ejectionTime);
+        }
+        // Successes while ejected do not reset the backoff
+        detector.recordSuccess("10.0.0.1:32767");
+        detector.ejectedUntil["10.0.0.1:32767"] = time.Now();
+    }
+
+    // A success once the ejection is over resets the backoff
+    detector.recordSuccess("10.0.0.1:32767");
+    detector.recordFailure("10.0.0.1:32767");
+    detector.recordFailure("10.0.0.1:32767");
+    var remaining time.Duration = time.Until(detector.ejectedUntil["10.0.0.1:32767"]);
+    if(remaining > time.Second || remaining < 900 * time.Millisecond) {
+        t.Errorf("ejected for %v after a success, expected 1s", remaining);
+    }
+}
+
+/*============================
+ TestOutlierDetectorOrder
+
+ Ejected host ports are moved last, and nothing is ejected when outlier detection
+ is disabled.
+============================*/
+func TestOutlierDetectorOrder(t *testing.T) {
+    var ports []PortsConfigurationData = []PortsConfigurationData{{hostPort: 31001}, {hostPort: 31002}, {hostPort: 31003}};
+    var tests = []struct {
+        consecutiveFailures int;
+        expected []int;
+    }{
+        {1, []int{31001, 31003, 31002}},
+        {0, []int{31001, 31002, 31003}},
+    };
+    for _, test := range tests {
+        var detector *OutlierDetector = newTestOutlierDetector(test.consecutiveFailures);
+        detector.recordFailure("31002");
+        var ordered []int = hostPortsOf(detector.orderHostPorts(ports));
+        if(!equalInts(ordered, test.expected)) {
+            t.Errorf("consecutiveFailures %d: got %v, expected %v", test.consecutiveFailures, ordered, test.expected);
+        }
+    }
+}
+
+/*============================
+ tcpConnectionPair
+
+ This procedure returns both ends of a loopback TCP connection.
+============================*/
+func tcpConnectionPair(t *testing.T) (net.Conn, net.Conn) {
+    var listener, err = net.Listen("tcp", "127.0.0.1:0");
+    if(err != nil) {
+        t.Fatalf("error listening: %v", err);
+    }
+    defer listener.Close();
+    var dialed net.Conn;
+    dialed, err = net.Dial("tcp", listener.Addr().String());
+    if(err != nil) {
+        t.Fatalf("error dialing: %v", err);
+    }
+    var accepted net.Conn;
+    accepted, err = listener.Accept();
+    if(err != nil) {
+        t.Fatalf("error accepting: %v", err);
+    }
+    return accepted, dialed;
+}
+
+/*============================
+ TestForwardConnectionsRetry
+
+ A host hanging up before sending anything leaves the client connection open, with
+ its data kept for another host. A host which sent any byte is never retried.
+============================*/
+func TestForwardConnectionsRetry(t *testing.T) {
+    var tests = []struct {
+        name string;
+        hostReply string;
+        replayable bool;
+        retry bool;
+        hostClosedEarly bool;
+    }{
+        {"early close", "", true, true, true},
+        {"early close without replay buffer", "", false, false, true},
+        {"close after reply", "ok", true, false, false},
+    };
+    for _, test := range tests {
+        var clientConnection, clientPeer = tcpConnectionPair(t);
+        var hostConnection, hostPeer = tcpConnectionPair(t);
+        defer clientPeer.Close();
+
+        // The host reads the client request, optionally replies, then hangs up
+        go func(hostPeer net.Conn, hostReply string) {
+            var request []byte = make([]byte, 5);
+            io.ReadFull(hostPeer, request);
+            hostPeer.Write([]byte(hostReply));
+            hostPeer.Close();
+        } (hostPeer, test.hostReply);
+        clientPeer.Write([]byte("hello"));
+
+        var replay *ReplayBuffer;
+        var clientReader io.Reader = clientConnection;
+        if(test.replayable) {
+            replay = &ReplayBuffer{reader: clientConnection, maxSize: 1024};
+            clientReader = replay;
+        }
+        var result ForwardResult = forwardConnections(clientConnection, clientReader, hostConnection, hostConnection, TimeoutSettings{}, replay);
+        if(result.retry != test.retry || result.hostClosedEarly != test.hostClosedEarly) {
+            t.Errorf("%s: got retry %v and hostClosedEarly %v, expected %v and %v", test.name, result.retry, result.hostClosedEarly, test.retry, test.hostClosedEarly);
+        }
+        if(result.bytesToHost != 5 || result.bytesToClient != int64(len(test.hostReply))) {
+            t.Errorf("%s: got %d bytes to host and %d bytes to client", test.name, result.bytesToHost, result.bytesToClient);
+        }
+
+        if(result.retry) {
+            // The client data is kept for the next host, and the client connection is still usable
+            if(!replay.replayable() || string(replay.data) != "hello") {
+                t.Errorf("%s: got replay data %q, expected %q", test.name, replay.data, "hello");
+            }
+            clientConnection.Write([]byte("retried"));
+            clientConnection.Close();
+        }
+        var received, _ = ioutil.ReadAll(clientPeer);
+        var expected string = test.hostReply;
+        if(result.retry) {
+            expected = "retried";
+        }
+        if(string(received) != expected) {
+            t.Errorf("%s: client received %q, expected %q", test.name, received, expected);
+        }
+    }
+}
+
+/*============================
+ TestHandshakeAuthenticatorVerify
+
+ Only handshakes signed with the cluster secret, for this host and these header
+ fields, within the clock skew and never seen before, are accepted.
+============================*/
+func TestHandshakeAuthenticatorVerify(t *testing.T) {
+    const target string = "10.0.0.1:32767";
+    var message string = handshakeMessage("192.168.0.1", "192.168.0.11", 56324, 443);
+    var authenticator *HandshakeAuthenticator = &HandshakeAuthenticator{
+        secret: []byte("secret"),
+        maxClockSkew: 30 * time.Second,
+        nonces: make(map[string]time.Time),
+    };
+    var forger *HandshakeAuthenticator = &HandshakeAuthenticator{secret: []byte("guess")};
+    var now int64 = time.Now().Unix();
+    var signedLine = func(signer *HandshakeAuthenticator, target string, message string, timestamp int64, nonce string) (string) {
+        return fmt.Sprintf("AUTH %d %s %s\r\n", timestamp, nonce, signer.signature(target, message, timestamp, nonce));
+    };
+    var validLine string = authenticator.sign(target, message);
+    var tests = []struct {
+        name string;
+        line string;
+        err string;
+    }{
+        {"valid", validLine, ""},
+        {"replayed", validLine, "replayed nonce"},
+        {"forged", signedLine(forger, target, message, now, "n1"), "invalid signature"},
+        {"other target", signedLine(authenticator, "10.0.0.2:32767", message, now, "n2"), "invalid signature"},
+        {"other header", signedLine(authenticator, target, handshakeMessage("192.168.0.2", "192.168.0.11", 56324, 443), now, "n3"), "invalid signature"},
+        {"skewed past", signedLine(authenticator, target, message, now - 60, "n4"), "timestamp off"},
+        {"skewed future", signedLine(authenticator, target, message, now + 60, "n5"), "timestamp off"},
+        {"within skew", signedLine(authenticator, target, message, now - 10, "n6"), ""},
+        {"invalid timestamp", "AUTH soon n7 00\r\n", "invalid timestamp"},
+        {"unsigned", "GET / HTTP/1.1\r\n", "unsigned handshake"},
+        {"missing", "", "error reading"},
+        {"oversized", "AUTH " + strings.Repeat("0", maxAuthLineLength) + "\r\n", "error reading"},
+    };
+    for _, test := range tests {
+        var err error = authenticator.verify(bufio.NewReader(strings.NewReader(test.line)), target, message);
+        if(test.err == "" && err != nil) {
+            t.Errorf("%s: %v", test.name, err);
+        } else if(test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err))) {
+            t.Errorf("%s: got error %v, expected %q", test.name, err, test.err);
+        }
+    }
+}
+
+/*============================
+ TestReadInternalHeader
+
+ Internal headers are read back as formatted, unknown fields are ignored, and
+ malformed or oversized headers are errors.
+============================*/
+func TestReadInternalHeader(t *testing.T) {
+    var header InternalHeader = InternalHeader{clusterPort: 29999, clientIp: "192.168.0.1", clientPort: 56324, proxyIp: "192.168.0.11", proxyPort: 443};
+    var headerWithProxy InternalHeader = header;
+    headerWithProxy.proxyHeader = "PROXY TCP4 10.1.0.1 192.168.0.11 41000 443";
+    var tests = []struct {
+        name string;
+        text string;
+        expected InternalHeader;
+        err string;
+    }{
+        {"formatted", formatInternalHeader(header), header, ""},
+        {"formatted with PP", formatInternalHeader(headerWithProxy), headerWithProxy, ""},
+        {"CRLF and unknown field", "CP=29999\r\nSRC=192.168.0.1 56324\r\nDST=192.168.0.11 443\r\nTAG=a\r\n\r\n", header, ""},
+        {"IPv6", "CP=29999\nSRC=fd00::1 56324\n\n", InternalHeader{clusterPort: 29999, clientIp: "fd00::1", clientPort: 56324}, ""},
+        {"missing CP", "SRC=192.168.0.1 56324\n\n", InternalHeader{}, "missing CP or SRC"},
+        {"missing SRC", "CP=29999\n\n", InternalHeader{}, "missing CP or SRC"},
+        {"malformed field", "CP=29999\nSRC\n\n", InternalHeader{}, "malformed field"},
+        {"malformed CP", "CP=http\n\n", InternalHeader{}, "malformed field"},
+        {"malformed address", "CP=29999\nSRC=192.168.0.1\n\n", InternalHeader{}, "malformed address"},
+        {"malformed IP", "CP=29999\nSRC=localhost 56324\n\n", InternalHeader{}, "malformed address"},
+        {"malformed PP", "CP=29999\nSRC=192.168.0.1 56324\nPP=GET /\n\n", InternalHeader{}, "malformed proxy protocol header"},
+        {"too many fields", strings.Repeat("X=1\n", 16) + "\n", InternalHeader{}, "too many fields"},
+        {"oversized line", "CP=29999\nSRC=192.168.0.1 56324\nPP=PROXY " + strings.Repeat("0", maxInternalHeaderLength) + "\n\n", InternalHeader{}, errHeaderTooLong.Error()},
+        {"oversized header", "CP=29999\n" + strings.Repeat("X=" + strings.Repeat("0", 100) + "\n", 6) + "\n", InternalHeader{}, errHeaderTooLong.Error()},
+        {"truncated", "CP=29999\nSRC=192.168.0.1 56324\n", InternalHeader{}, io.EOF.Error()},
+    };
+    for _, test := range tests {
+        var reader *bufio.Reader = bufio.NewReader(strings.NewReader(test.text + "client data"));
+        var got, text, err = readInternalHeader(reader);
+        if(test.err != "") {
+            if(err == nil || !strings.Contains(err.Error(), test.err)) {
+                t.Errorf("%s: got error %v, expected %q", test.name, err, test.err);
+            }
+            continue;
+        }
+        if(err != nil) {
+            t.Errorf("%s: %v", test.name, err);
+            continue;
+        }
+        if(got != test.expected || text != test.text) {
+            t.Errorf("%s: got %+v and %q, expected %+v and %q", test.name, got, text, test.expected, test.text);
+        }
+        // Client data following the header is left unread
+        var rest, _ = ioutil.ReadAll(reader);
+        if(string(rest) != "client data") {
+            t.Errorf("%s: got client data %q", test.name, rest);
+        }
+    }
+}
+
+/*============================
+ TestLoadAccessControl
+
+ Access control files are read into allow and deny rules per cluster port, and
+ rejected as a whole on any invalid rule.
+============================*/
+func TestLoadAccessControl(t *testing.T) {
+    var tests = []struct {
+        name string;
+        content string;
+        allows map[int]int;
+        denies map[int]int;
+        fails bool;
+    }{
+        {
+            "valid",
+            "# comment\n\n27017:allow:10.0.0.0/8,192.168.1.10\n27017:deny:10.0.99.0/24\n8080:deny:0.0.0.0/0,::/0\n27017:allow:fd00::/8\n",
+            map[int]int{27017: 3, 8080: 0},
+            map[int]int{27017: 1, 8080: 2},
+            false,
+        },
+        {"invalid cluster port", "http:allow:10.0.0.0/8\n", nil, nil, true},
+        {"invalid action", "27017:permit:10.0.0.0/8\n", nil, nil, true},
+        {"invalid CIDR", "27017:allow:10.0.0.0/33\n", nil, nil, true},
+        {"missing field", "27017:allow\n", nil, nil, true},
+    };
+    for _, test := range tests {
+        var cfgFilePath string = filepath.Join(t.TempDir(), "access.conf");
+        if(ioutil.WriteFile(cfgFilePath, []byte(test.content), 0644) != nil) {
+            t.Fatalf("error writing %s", cfgFilePath);
+        }
+        var accessControl, err = loadAccessControl(cfgFilePath);
+        if(test.fails) {
+            if(err == nil) {
+                t.Errorf("%s: expected an error", test.name);
+            }
+            continue;
+        }
+        if(err != nil) {
+            t.Fatalf("%s: %v", test.name, err);
+        }
+        if(len(accessControl) != len(test.allows)) {
+            t.Errorf("%s: got rules for %d cluster ports, expected %d", test.name, len(accessControl), len(test.allows));
+        }
+        var clusterPort int;
+        var rules *AccessControlData;
+        for clusterPort, rules = range accessControl {
+            if(len(rules.allow) != test.allows[clusterPort] || len(rules.deny) != test.denies[clusterPort]) {
+                t.Errorf("%s: cluster port %d got %d allow and %d deny rules", test.name, clusterPort, len(rules.allow), len(rules.deny));
+            }
+        }
+    }
+
+    var _, err = loadAccessControl(filepath.Join(t.TempDir(), "missing.conf"));
+    if(!os.IsNotExist(err)) {
+        t.Errorf("missing file: got error %v", err);
+    }
+}
+
+/*============================
+ TestIsClientAllowed
+
+ Deny rules take precedence, allow rules restrict the cluster port to matching
+ clients, and cluster ports without rules accept all clients.
+============================*/
+func TestIsClientAllowed(t *testing.T) {
+    var cfgFilePath string = filepath.Join(t.TempDir(), "access.conf");
+    var content string = "27017:allow:10.0.0.0/8,192.168.1.10,fd00::/8\n27017:deny:10.0.99.0/24\n8080:deny:0.0.0.0/0\n";
+    if(ioutil.WriteFile(cfgFilePath, []byte(content), 0644) != nil) {
+        t.Fatalf("error writing %s", cfgFilePath);
+    }
+    var accessControl, err = loadAccessControl(cfgFilePath);
+    if(err != nil) {
+        t.Fatalf("%v", err);
+    }
+    var tests = []struct {
+        clusterPort int;
+        clientIp string;
+        allowed bool;
+    }{
+        {27017, "10.1.2.3", true},
+        {27017, "192.168.1.10", true},
+        {27017, "fd00::5", true},
+        {27017, "10.0.99.7", false},
+        {27017, "192.168.1.11", false},
+        {27017, "fe80::1", false},
+        {27017, "not an ip", false},
+        {8080, "10.1.2.3", false},
+        {8080, "fd00::5", true},
+        {443, "203.0.113.9", true},
+    };
+    for _, test := range tests {
+        if(isClientAllowed(accessControl, test.clusterPort, test.clientIp) != test.allowed) {
+            t.Errorf("cluster port %d, client %s: expected allowed %v", test.clusterPort, test.clientIp, test.allowed);
+        }
+    }
+    if(!isClientAllowed(nil, 27017, "10.0.99.7")) {
+        t.Errorf("expected all clients allowed without access control");
+    }
+}
+
+/*============================
+ TestClientLimiterAcquire
+
+ Each client IP gets, per cluster port, a token bucket and a maximum number of
+ active connections.
+============================*/
+func TestClientLimiterAcquire(t *testing.T) {
+    type limiterStep struct {
+        clusterPort int;
+        clientIp string;
+        release bool;
+        wait time.Duration;
+        reason string;
+    };
+    var tests = []struct {
+        name string;
+        limits ClientLimitSettings;
+        steps []limiterStep;
+    }{
+        {
+            "unlimited",
+            ClientLimitSettings{},
+            []limiterStep{{29999, "10.0.0.1", false, 0, ""}, {29999, "10.0.0.1", false, 0, ""}, {29999, "10.0.0.1", false, 0, ""}},
+        },
+        {
+            "burst",
+            ClientLimitSettings{rate: 1, burst: 2},
+            []limiterStep{
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, "rate_limit"},
+                {29999, "10.0.0.2", false, 0, ""},
+                {29998, "10.0.0.1", false, 0, ""},
+                // Releasing a connection gives no token back
+                {29999, "10.0.0.1", true, 0, ""},
+                {29999, "10.0.0.1", false, 0, "rate_limit"},
+            },
+        },
+        {
+            "refill",
+            ClientLimitSettings{rate: 10, burst: 1},
+            []limiterStep{
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, "rate_limit"},
+                {29999, "10.0.0.1", false, 110 * time.Millisecond, ""},
+                {29999, "10.0.0.1", false, 0, "rate_limit"},
+            },
+        },
+        {
+            "concurrency",
+            ClientLimitSettings{maxConnections: 2},
+            []limiterStep{
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, "concurrency_limit"},
+                {29999, "10.0.0.2", false, 0, ""},
+                {29999, "10.0.0.1", true, 0, ""},
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, "concurrency_limit"},
+            },
+        },
+        {
+            // Rejected connections neither take a token nor a connection slot
+            "rate and concurrency",
+            ClientLimitSettings{rate: 1, burst: 2, maxConnections: 1},
+            []limiterStep{
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", false, 0, "concurrency_limit"},
+                {29999, "10.0.0.1", true, 0, ""},
+                {29999, "10.0.0.1", false, 0, ""},
+                {29999, "10.0.0.1", true, 0, ""},
+                {29999, "10.0.0.1", false, 0, "rate_limit"},
+                {29999, "10.0.0.1", false, 0, "rate_limit"},
+            },
+        },
+    };
+    for _, test := range tests {
+        var limiter *ClientLimiter = &ClientLimiter{clients: make(map[string]*ClientBucket)};
+        var index int;
+        var step limiterStep;
+        for index, step = range test.steps {
+            time.Sleep(step.wait);
+            if(step.release) {
+                limiter.release(step.clusterPort, step.clientIp);
+                continue;
+            }
+            var reason string = limiter.acquire(step.clusterPort, step.clientIp, test.limits);
+            if(reason != step.reason) {
+                t.Errorf("%s, step %d: got %q, expected %q", test.name, index, reason, step.reason);
+            }
+        }
+    }
+}
+
+/*============================
+ TestReadHeaderLine
+
+ Header lines are returned once complete, even when sent in several parts, and
+ reading fails on lines longer than the maximum or on clients stalling past the
+ connection deadline.
+============================*/
+func TestReadHeaderLine(t *testing.T) {
+    var tests = []struct {
+        name string;
+        parts []string;
+        line string;
+        reason string;
+    }{
+        {"complete", []string{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET /"}, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", ""},
+        {"in parts", []string{"PROXY TCP4 192.168.0.1 ", "192.168.0.11 56324 443", "\r\n"}, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", ""},
+        {"maximum length", []string{strings.Repeat("0", proxyProtocolMaxHeaderLength - 1) + "\n"}, strings.Repeat("0", proxyProtocolMaxHeaderLength - 1) + "\n", ""},
+        {"too long", []string{strings.Repeat("0", proxyProtocolMaxHeaderLength) + "\n"}, "", "header_too_long"},
+        {"too long in parts", []string{strings.Repeat("0", 60), strings.Repeat("0", 60)}, "", "header_too_long"},
+        {"stalled", []string{"PROXY TCP4 "}, "", "header_timeout"},
+        {"silent", nil, "", "header_timeout"},
+    };
+    for _, test := range tests {
+        var connection, client = net.Pipe();
+        go func(parts []string) {
+            var part string;
+            for _, part = range parts {
+                client.Write([]byte(part));
+            }
+        } (test.parts);
+        connection.SetReadDeadline(time.Now().Add(100 * time.Millisecond));
+        var line, err = readHeaderLine(bufio.NewReader(connection), proxyProtocolMaxHeaderLength);
+        if(test.reason != "") {
+            if(err == nil || headerErrorReason(err) != test.reason) {
+                t.Errorf("%s: got error %v, expected %s", test.name, err, test.reason);
+            }
+        } else if(err != nil || line != test.line) {
+            t.Errorf("%s: got %q and error %v, expected %q", test.name, line, err, test.line);
+        }
+        connection.Close();
+        client.Close();
+    }
+}
+
+/*============================
+ TestByteRateLimiterChunkSize
+
+ Throttled reads are split into chunks of a tenth of the rate, 512 bytes at least.
+============================*/
+func TestByteRateLimiterChunkSize(t *testing.T) {
+    var tests = []struct {
+        rate int64;
+        size int;
+        expected int;
+    }{
+        {0, 32768, 32768},
+        {1000, 32768, 512},
+        {100000, 32768, 10000},
+        {100000, 4096, 4096},
+        {10000000, 32768, 32768},
+    };
+    for _, test := range tests {
+        var limiter *ByteRateLimiter = &ByteRateLimiter{rate: test.rate};
+        var chunk int = limiter.chunkSize(test.size);
+        if(chunk != test.expected) {
+            t.Errorf("rate %d, size %d: got %d, expected %d", test.rate, test.size, chunk, test.expected);
+        }
+    }
+}
+
+/*============================
+ TestByteRateLimiterWait
+
+ Up to one second of traffic goes through at once, then transfers wait for as long
+ as the rate requires. Without a rate, transfers never wait.
+============================*/
+func TestByteRateLimiterWait(t *testing.T) {
+    var tests = []struct {
+        name string;
+        rate int64;
+        counts []int;
+        minimum time.Duration;
+        maximum time.Duration;
+    }{
+        {"unlimited", 0, []int{1000000, 1000000}, 0, 50 * time.Millisecond},
+        {"burst", 10000, []int{5000, 5000}, 0, 50 * time.Millisecond},
+        {"throttled", 10000, []int{10000, 2000}, 200 * time.Millisecond, 300 * time.Millisecond},
+        {"debt paid off", 10000, []int{13000, 1000}, 400 * time.Millisecond, 500 * time.Millisecond},
+    };
+    for _, test := range tests {
+        var limiter *ByteRateLimiter = &ByteRateLimiter{rate: test.rate};
+        var start time.Time = time.Now();
+        var count int;
+        for _, count = range test.counts {
+            limiter.wait(count);
+        }
+        var elapsed time.Duration = time.Since(start);
+        if(elapsed < test.minimum || elapsed > test.maximum) {
+            t.Errorf("%s: waited %v, expected between %v and %v", test.name, elapsed, test.minimum, test.maximum);
+        }
+    }
+
+    // Removing the limit forgives any debt, the limit applying again from an empty bucket
+    var limiter *ByteRateLimiter = &ByteRateLimiter{rate: 1000};
+    limiter.tokens = -1000000;
+    limiter.updated = time.Now();
+    limiter.setRate(0);
+    var start time.Time = time.Now();
+    limiter.wait(1000);
+    limiter.setRate(1000);
+    limiter.wait(100);
+    if(time.Since(start) < 100 * time.Millisecond || time.Since(start) > 200 * time.Millisecond) {
+        t.Errorf("waited %v after the limit was removed, expected 100ms", time.Since(start));
+    }
+}